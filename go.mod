@@ -1,3 +1,13 @@
 module fdms
 
 go 1.22.3
+
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/time v0.5.0
+)
+
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
@@ -1,112 +1,800 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/time/rate"
 )
 
-var apiKey string
-var certPath string
+const defaultAPIBaseURL = "https://api.regulations.gov/v4"
+const defaultDocketID = "NIST-2024-0001"
+const defaultCachePath = "cache.json"
+const defaultOutputDir = "static"
+const defaultAutocertDir = "autocert"
+const postedDateLayout = "2006-01-02"
+const defaultUserAgent = "FDMS-archiver/1.0 (+https://github.com/jpe90/FDMS)"
+
+const (
+	downloadInterval = 500 * time.Millisecond
+	pageSize         = 250
+	// maxPageNumber is the highest page[number] the API accepts, so one
+	// listing request returns at most maxPageNumber*pageSize results.
+	maxPageNumber = 20
+
+	// regulations.gov allows 1000 requests per hour for a registered key.
+	defaultRequestsPerHour = 1000
+	rateLimitBurst         = 10
+
+	// Once fewer than lowQuotaFraction of the hourly quota remains, requests
+	// are slowed to lowQuotaSlowdown of the configured rate.
+	lowQuotaFraction = 0.1
+	lowQuotaSlowdown = 0.25
+
+	// watermarkOverlap is subtracted from incremental sync watermarks to
+	// tolerate clock skew between us and the API.
+	watermarkOverlap = 5 * time.Minute
+
+	defaultHTTPTimeout = 30 * time.Second
+
+	defaultRefreshInterval = 5 * time.Minute
+	minRefreshInterval     = 10 * time.Second
+
+	shutdownTimeout = 10 * time.Second
 
-const docketID = "NIST-2024-0001"
+	// certExpiryWarning is how close to expiry a TLS certificate may get
+	// before startup warns about it.
+	certExpiryWarning = 30 * 24 * time.Hour
+
+	defaultFetchConcurrency  = 4
+	defaultMirrorConcurrency = 2
+
+	// refreshDebounce is the minimum time between manual refreshes.
+	refreshDebounce = time.Minute
+
+	defaultMaxAttempts = 5
+	retryBaseDelay     = 1 * time.Second
+	retryMaxDelay      = 30 * time.Second
+)
 
 // -------------------------- utilities
 
-func fetchJSON(url string, headers map[string]string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// errNotModified is returned by fetchJSON when a conditional request is
+// answered with 304 Not Modified.
+//
+// The list endpoints send If-Modified-Since: /documents with the time of the
+// last listing of the docket, and /comments with the docket's watermark. The
+// regulations.gov v4 API does not document support for conditional requests,
+// so this only saves work where a 304 actually comes back, e.g. from a caching
+// proxy; a 200 is processed as before.
+var errNotModified = errors.New("not modified")
+
+type StatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration
+	// Body holds the start of the response body, for diagnostics.
+	Body string
+	// APIErrors holds the JSON:API error objects in the body, if any.
+	APIErrors []APIError
+}
+
+func (e *StatusError) Error() string {
+	if len(e.APIErrors) > 0 {
+		messages := make([]string, len(e.APIErrors))
+		for i, apiErr := range e.APIErrors {
+			messages[i] = apiErr.Error()
+		}
+		return fmt.Sprintf("status %d from %s: %s", e.StatusCode, e.URL, strings.Join(messages, "; "))
+	}
+	if e.Body == "" {
+		return fmt.Sprintf("unexpected status %d from %s", e.StatusCode, e.URL)
+	}
+	return fmt.Sprintf("unexpected status %d from %s: %s", e.StatusCode, e.URL, e.Body)
+}
+
+// APIError is a JSON:API error object, as returned by regulations.gov in the
+// errors array of a failed request.
+type APIError struct {
+	Status string `json:"status"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (e APIError) Error() string {
+	switch {
+	case e.Title != "" && e.Detail != "":
+		return e.Title + ": " + e.Detail
+	case e.Title != "":
+		return e.Title
+	case e.Detail != "":
+		return e.Detail
+	}
+	return "API error " + e.Status
+}
+
+// parseAPIErrors returns the error objects of a JSON:API error envelope, or
+// nil if body is not one.
+func parseAPIErrors(body []byte) []APIError {
+	var envelope struct {
+		Errors []APIError `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil
+	}
+	return envelope.Errors
+}
+
+const (
+	bodySnippetLength = 200
+	// maxErrorBodyBytes bounds how much of a failed response is read.
+	maxErrorBodyBytes = 64 << 10
+)
+
+func bodySnippet(body []byte) string {
+	snippet, _ := truncateText(strings.TrimSpace(string(body)), bodySnippetLength)
+	return snippet
+}
+
+// decodeJSON unmarshals an API response, naming the endpoint and quoting the
+// start of the body when the response does not have the expected shape.
+func decodeJSON(url string, body []byte, v any) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("decoding response from %s: %w (body: %q)", url, err, bodySnippet(body))
+	}
+	return nil
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << attempt
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// writeFileAtomic writes to a temporary file next to path and renames it into
+// place, so readers never observe a partially written file.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func configValue(flagValue, envKey string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(envKey)
+}
+
+func parsePort(value string) (string, error) {
+	port, err := strconv.Atoi(strings.TrimPrefix(value, ":"))
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid port %q", value)
+	}
+	return strconv.Itoa(port), nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// -------------------------- API client
+
+// APIClient makes requests to the regulations.gov API. All requests share its
+// HTTP client and retry policy. Requests rotate round-robin among the
+// configured API keys; each key has its own rate limiter, which is slowed down
+// when the quota the API reports for that key runs low, and a key that gets a
+// 429 is skipped until its Retry-After has passed.
+type APIClient struct {
+	keys       []*apiKey
+	next       atomic.Uint64
+	baseURL    string
+	userAgent  string
+	httpClient *http.Client
+	// downloadClient fetches attachments. It has no overall timeout, since
+	// a large file can take longer than any API response should; only the
+	// wait for response headers is bounded, and ctx cancels the rest.
+	downloadClient *http.Client
+	rate           rate.Limit
+	maxAttempts    int
+	// downloads paces attachment downloads across all mirroring workers.
+	downloads *rate.Limiter
+}
+
+type apiKey struct {
+	value   string
+	limiter *rate.Limiter
+	quota   quotaTracker
+}
+
+// CommentSource is the part of the API the updater lists and fetches
+// comments through. APIClient implements it.
+type CommentSource interface {
+	DocumentObjectIDs(ctx context.Context, docketID string, modifiedSince time.Time) ([]string, error)
+	CommentIDs(ctx context.Context, documentID string, since time.Time, postedStart, postedEnd string) ([]CommentID, error)
+	Comment(ctx context.Context, commentID string) (Comment, error)
+	Attachments(ctx context.Context, attachmentURL string) ([]Attachment, error)
+}
+
+var _ CommentSource = (*APIClient)(nil)
+
+// newAPIClient builds a client from cfg; newAPIClient(defaultConfig()) plus an
+// API key gives the default behavior. Outbound requests honor HTTP_PROXY,
+// HTTPS_PROXY, and NO_PROXY unless cfg.ProxyURL overrides them.
+func newAPIClient(cfg *Config) *APIClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if cfg.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(cfg.ProxyURL)
+	}
+	downloadTransport := transport.Clone()
+	downloadTransport.ResponseHeaderTimeout = cfg.HTTPTimeout
+	limit := requestsPerHour(cfg.RequestsPerHour)
+	client := &APIClient{
+		baseURL:        cfg.APIBaseURL,
+		userAgent:      cfg.UserAgent,
+		httpClient:     &http.Client{Timeout: cfg.HTTPTimeout, Transport: transport},
+		downloadClient: &http.Client{Transport: downloadTransport},
+		rate:           limit,
+		maxAttempts:    cfg.MaxAttempts,
+		downloads:      rate.NewLimiter(rate.Every(downloadInterval), 1),
+	}
+	for _, key := range cfg.APIKeys {
+		client.keys = append(client.keys, &apiKey{value: key, limiter: rate.NewLimiter(limit, rateLimitBurst)})
+	}
+	if len(client.keys) == 0 {
+		// Serve-only processes never call the API but still report quota.
+		client.keys = []*apiKey{{limiter: rate.NewLimiter(limit, rateLimitBurst)}}
+	}
+	return client
+}
+
+func requestsPerHour(n int) rate.Limit {
+	return rate.Limit(float64(n) / time.Hour.Seconds())
+}
+
+// requestRate is the combined rate of all keys, in requests per second.
+func (c *APIClient) requestRate() rate.Limit {
+	return c.rate * rate.Limit(len(c.keys))
+}
+
+// nextKey returns the next key in rotation, skipping keys that are waiting out
+// a 429 unless every key is.
+func (c *APIClient) nextKey() *apiKey {
+	now := time.Now()
+	for range c.keys {
+		key := c.keys[c.next.Add(1)%uint64(len(c.keys))]
+		if !key.quota.blocked(now) {
+			return key
+		}
+	}
+	return c.keys[c.next.Add(1)%uint64(len(c.keys))]
+}
+
+func (c *APIClient) fetchJSON(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		key := c.nextKey()
+		if attempt > 0 {
+			delay := backoffDelay(attempt - 1)
+			var statusErr *StatusError
+			if errors.As(lastErr, &statusErr) && statusErr.RetryAfter > 0 {
+				delay = statusErr.RetryAfter
+			}
+			if errors.As(lastErr, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests && !key.quota.blocked(time.Now()) {
+				// Another key still has quota; switch to it right away.
+				delay = 0
+			}
+			slog.Warn("retrying request", "url", url, "delay", delay, "attempt", attempt+1, "maxAttempts", c.maxAttempts, "error", lastErr)
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+
+		body, err := c.fetchOnce(ctx, key, url, headers)
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errNotModified) {
+			return nil, err
+		}
+		lastErr = err
+
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && !retryableStatus(statusErr.StatusCode) {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *APIClient) fetchOnce(ctx context.Context, key *apiKey, url string, headers map[string]string) ([]byte, error) {
+	if err := key.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	for key, value := range headers {
-		req.Header.Add(key, value)
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("X-Api-Key", key.value)
+	for name, value := range headers {
+		req.Header.Add(name, value)
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	metrics.apiRequests.Add(1)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		metrics.apiFailures.Add(1)
 		return nil, err
 	}
 	defer resp.Body.Close()
+	c.recordQuota(key, resp.Header)
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, errNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		metrics.apiFailures.Add(1)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		statusErr := &StatusError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Body:       bodySnippet(body),
+			APIErrors:  parseAPIErrors(body),
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			key.quota.block(statusErr.RetryAfter)
+		}
+		return nil, statusErr
+	}
 	return ioutil.ReadAll(resp.Body)
 }
 
-func rateLimitedRequest(interval time.Duration, fn func(string) ([]string, error), id string) ([]string, error) {
-	time.Sleep(interval)
-	return fn(id)
+type QuotaStatus struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type quotaTracker struct {
+	mu     sync.Mutex
+	status QuotaStatus
+	slowed bool
+	// blockedUntil is set when the key gets a 429.
+	blockedUntil time.Time
+}
+
+// block takes a key out of rotation after a 429, for retryAfter or, if the
+// API gave no Retry-After, retryMaxDelay.
+func (q *quotaTracker) block(retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = retryMaxDelay
+	}
+	q.mu.Lock()
+	q.blockedUntil = time.Now().Add(retryAfter)
+	q.mu.Unlock()
+}
+
+func (q *quotaTracker) blocked(now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return now.Before(q.blockedUntil)
+}
+
+// recordQuota tracks the rate limit headers of a response and slows the key
+// down while its remaining quota is low.
+func (c *APIClient) recordQuota(key *apiKey, header http.Header) {
+	limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	q := &key.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.status = QuotaStatus{Limit: limit, Remaining: remaining, UpdatedAt: time.Now()}
+
+	low := float64(remaining) < float64(limit)*lowQuotaFraction
+	if low && !q.slowed {
+		slog.Warn("API quota low, slowing requests", "key", c.keyIndex(key), "remaining", remaining, "limit", limit)
+		key.limiter.SetLimit(c.rate * lowQuotaSlowdown)
+	} else if !low && q.slowed {
+		slog.Info("API quota recovered, resuming normal rate", "key", c.keyIndex(key), "remaining", remaining, "limit", limit)
+		key.limiter.SetLimit(c.rate)
+	}
+	q.slowed = low
+}
+
+// keyIndex identifies a key in logs without revealing it.
+func (c *APIClient) keyIndex(key *apiKey) int {
+	return slices.Index(c.keys, key)
+}
+
+// quotaStatus sums the last reported quota of every key.
+func (c *APIClient) quotaStatus() (QuotaStatus, bool) {
+	var total QuotaStatus
+	for _, key := range c.keys {
+		key.quota.mu.Lock()
+		status := key.quota.status
+		key.quota.mu.Unlock()
+		if status.UpdatedAt.IsZero() {
+			continue
+		}
+		total.Limit += status.Limit
+		total.Remaining += status.Remaining
+		if status.UpdatedAt.After(total.UpdatedAt) {
+			total.UpdatedAt = status.UpdatedAt
+		}
+	}
+	return total, !total.UpdatedAt.IsZero()
+}
+
+// ------------------ listings
+
+// listPage is what listAll needs to know about one page of a listing.
+type listPage struct {
+	Meta  PageMeta
+	Items int
+	// LastModified is the lastModifiedDate of the last result on the page.
+	LastModified string
+}
+
+// lastModifiedFilter returns the query parameter limiting a listing to results
+// modified at or after since, or "" if since is zero. The API expects the date
+// in Eastern time.
+func lastModifiedFilter(since time.Time) string {
+	if since.IsZero() {
+		return ""
+	}
+	if loc, err := time.LoadLocation("America/New_York"); err == nil {
+		since = since.In(loc)
+	}
+	return "&filter[lastModifiedDate][ge]=" + url.QueryEscape(since.Format("2006-01-02 15:04:05"))
+}
+
+// listAll requests every page of the listing at listURL, sorted by sortBy,
+// and passes each response to decode. A non-zero since limits the listing to
+// results modified at or after it, and headers are sent with the first request
+// only.
+//
+// The API serves at most maxPageNumber pages, so sortBy must start with
+// lastModifiedDate: when a listing has more pages, it is requested again from
+// the lastModifiedDate of the last result seen. Results modified at that time
+// appear in both windows, so decode must drop IDs it has already seen.
+func (c *APIClient) listAll(ctx context.Context, listURL, sortBy string, since time.Time, headers map[string]string, decode func(url string, body []byte) (listPage, error)) error {
+	for {
+		var windowItems int
+		var last string
+		for page := 1; ; page++ {
+			url := fmt.Sprintf("%s%s&sort=%s&page[size]=%d&page[number]=%d", listURL, lastModifiedFilter(since), sortBy, pageSize, page)
+			body, err := c.fetchJSON(ctx, url, headers)
+			if err != nil {
+				return err
+			}
+			headers = nil
+
+			result, err := decode(url, body)
+			if err != nil {
+				return err
+			}
+			windowItems += result.Items
+			if result.LastModified != "" {
+				last = result.LastModified
+			}
+			if result.Items == 0 || page >= result.Meta.TotalPages ||
+				(result.Meta.TotalElements > 0 && windowItems >= result.Meta.TotalElements) {
+				return nil
+			}
+			if page == maxPageNumber {
+				break
+			}
+		}
+
+		next, err := time.Parse(time.RFC3339, last)
+		if err != nil {
+			return fmt.Errorf("listing %s past page %d: invalid lastModifiedDate %q: %w", listURL, maxPageNumber, last, err)
+		}
+		if !next.Truncate(time.Second).After(since.Truncate(time.Second)) {
+			return fmt.Errorf("listing %s past page %d: more than %d results modified at %s", listURL, maxPageNumber, maxPageNumber*pageSize, last)
+		}
+		slog.Debug("listing has more than the API pages through, continuing from the last modification", "url", listURL, "since", next)
+		since = next
+	}
 }
 
 // ------------------ documents
 
+// docketIDPattern matches agency-year-number docket IDs such as NIST-2024-0001,
+// allowing the sub-agency and type segments some agencies add, as in
+// EPA-HQ-OAR-2021-0317 or FDA-2013-N-0500.
+var docketIDPattern = regexp.MustCompile(`^[A-Z]+(-[A-Z0-9]+)*-[0-9]{4}(-[A-Z0-9]+)+$`)
+
+func validDocketID(docketID string) bool {
+	return docketIDPattern.MatchString(docketID)
+}
+
 type Document struct {
 	Attributes DocumentAttributes `json:"attributes"`
 }
 
 type DocumentAttributes struct {
-	ObjectID string `json:"objectId"`
+	ObjectID         string `json:"objectId"`
+	LastModifiedDate string `json:"lastModifiedDate"`
 }
 
-func getDocumentObjectIDs() ([]string, error) {
-	url := fmt.Sprintf("https://api.regulations.gov/v4/documents?filter[docketId]=%s", docketID)
-	headers := map[string]string{"X-Api-Key": apiKey}
-	body, err := fetchJSON(url, headers)
-	if err != nil {
-		return nil, err
+// DocumentObjectIDs lists the object IDs of a docket's documents. If
+// modifiedSince is set, the first page is requested with If-Modified-Since and
+// errNotModified is returned if the API answers 304.
+func (c *APIClient) DocumentObjectIDs(ctx context.Context, docketID string, modifiedSince time.Time) ([]string, error) {
+	var headers map[string]string
+	if !modifiedSince.IsZero() {
+		headers = map[string]string{"If-Modified-Since": modifiedSince.UTC().Format(http.TimeFormat)}
 	}
-
-	var data Data
-	err = json.Unmarshal(body, &data)
+	var objectIds []string
+	seen := make(map[string]bool)
+	listURL := fmt.Sprintf("%s/documents?filter[docketId]=%s", c.baseURL, docketID)
+	err := c.listAll(ctx, listURL, "lastModifiedDate,documentId", time.Time{}, headers, func(url string, body []byte) (listPage, error) {
+		var data Data
+		if err := decodeJSON(url, body, &data); err != nil {
+			return listPage{}, err
+		}
+		page := listPage{Meta: data.Meta, Items: len(data.Data)}
+		for _, doc := range data.Data {
+			page.LastModified = doc.Attributes.LastModifiedDate
+			if !seen[doc.Attributes.ObjectID] {
+				seen[doc.Attributes.ObjectID] = true
+				objectIds = append(objectIds, doc.Attributes.ObjectID)
+			}
+		}
+		return page, nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return objectIds, nil
+}
 
-	var objectIds []string
-	for _, doc := range data.Data {
-		objectIds = append(objectIds, doc.Attributes.ObjectID)
+// validateKeys makes one request with each key, so that a rejected key is
+// reported at startup rather than failing requests at random later.
+func (c *APIClient) validateKeys(ctx context.Context) error {
+	url := c.baseURL + "/documents?page[size]=5"
+	for i, key := range c.keys {
+		if _, err := c.fetchOnce(ctx, key, url, nil); err != nil {
+			return fmt.Errorf("API key %d of %d: %w", i+1, len(c.keys), err)
+		}
 	}
+	return nil
+}
 
-	return objectIds, nil
+// ------------------ agency dockets
+
+type DocketData struct {
+	Data []struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			LastModifiedDate string `json:"lastModifiedDate"`
+		} `json:"attributes"`
+	} `json:"data"`
+	Meta PageMeta `json:"meta"`
+}
+
+var agencyIDPattern = regexp.MustCompile(`^[A-Z]+$`)
+
+func (c *APIClient) AgencyDocketIDs(ctx context.Context, agencyID string) ([]string, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	listURL := fmt.Sprintf("%s/dockets?filter[agencyId]=%s", c.baseURL, agencyID)
+	err := c.listAll(ctx, listURL, "lastModifiedDate,docketId", time.Time{}, nil, func(url string, body []byte) (listPage, error) {
+		var data DocketData
+		if err := decodeJSON(url, body, &data); err != nil {
+			return listPage{}, err
+		}
+		page := listPage{Meta: data.Meta, Items: len(data.Data)}
+		for _, docket := range data.Data {
+			page.LastModified = docket.Attributes.LastModifiedDate
+			if !seen[docket.ID] {
+				seen[docket.ID] = true
+				ids = append(ids, docket.ID)
+			}
+		}
+		return page, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
 }
 
 // ----------------- comment IDS
 
 type CommentData struct {
 	Data []CommentID `json:"data"`
+	Meta PageMeta    `json:"meta"`
+}
+
+type PageMeta struct {
+	TotalElements int  `json:"totalElements"`
+	TotalPages    int  `json:"totalPages"`
+	LastPage      bool `json:"lastPage"`
 }
 
 type Data struct {
 	Data []Document `json:"data"`
+	Meta PageMeta   `json:"meta"`
 }
 
 type CommentID struct {
-	ID string `json:"id"`
+	ID         string `json:"id"`
+	Attributes struct {
+		LastModifiedDate string `json:"lastModifiedDate"`
+	} `json:"attributes"`
 }
 
-func getCommentIDs(documentID string) ([]string, error) {
-	url := fmt.Sprintf("https://api.regulations.gov/v4/comments?filter[commentOnId]=%s&page[size]=250&page[number]=1", documentID)
-	headers := map[string]string{"X-Api-Key": apiKey}
-	body, err := fetchJSON(url, headers)
-	if err != nil {
-		return nil, err
+// commentFilters returns the posted date query parameters for comment
+// listings.
+func commentFilters(postedStart, postedEnd string) string {
+	var filter string
+	if postedStart != "" {
+		filter += "&filter[postedDate][ge]=" + postedStart
 	}
+	if postedEnd != "" {
+		filter += "&filter[postedDate][le]=" + postedEnd
+	}
+	return filter
+}
 
-	var data CommentData
-	err = json.Unmarshal(body, &data)
+// CommentIDs lists the comments on a document modified since the given
+// time, or all of them if since is zero. The first page is also sent with
+// If-Modified-Since, and a 304 answer is taken to mean nothing has changed.
+func (c *APIClient) CommentIDs(ctx context.Context, documentID string, since time.Time, postedStart, postedEnd string) ([]CommentID, error) {
+	var headers map[string]string
+	if !since.IsZero() {
+		headers = map[string]string{"If-Modified-Since": since.UTC().Format(http.TimeFormat)}
+	}
+	var ids []CommentID
+	seen := make(map[string]bool)
+	listURL := fmt.Sprintf("%s/comments?filter[commentOnId]=%s%s", c.baseURL, documentID, commentFilters(postedStart, postedEnd))
+	err := c.listAll(ctx, listURL, "lastModifiedDate,documentId", since, headers, func(url string, body []byte) (listPage, error) {
+		var data CommentData
+		if err := decodeJSON(url, body, &data); err != nil {
+			return listPage{}, err
+		}
+		page := listPage{Meta: data.Meta, Items: len(data.Data)}
+		for _, id := range data.Data {
+			page.LastModified = id.Attributes.LastModifiedDate
+			if !seen[id.ID] {
+				seen[id.ID] = true
+				ids = append(ids, id)
+			}
+		}
+		return page, nil
+	})
+	if errors.Is(err, errNotModified) {
+		slog.Debug("comment list not modified", "document", documentID, "since", since)
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-
-	var ids []string
-	for _, comment := range data.Data {
-		ids = append(ids, comment.ID)
-	}
-
 	return ids, nil
 }
 
@@ -124,6 +812,17 @@ type Comment struct {
 			Email        string `json:"email"`
 			Organization string `json:"organization"`
 			Comment      string `json:"comment"`
+			PostedDate   string `json:"postedDate"`
+			ReceiveDate  string `json:"receiveDate"`
+			// SubmitterType is e.g. "Individual", "Organization", or
+			// "Government Agency".
+			SubmitterType string `json:"submitterType"`
+			GovAgency     string `json:"govAgency"`
+			GovAgencyType string `json:"govAgencyType"`
+			City          string `json:"city"`
+			State         string `json:"stateProvinceRegion"`
+			Country       string `json:"country"`
+			Zip           string `json:"zip"`
 		} `json:"attributes"`
 		ID            string `json:"id"`
 		Relationships struct {
@@ -131,296 +830,3859 @@ type Comment struct {
 				Links struct {
 					Related string `json:"related"`
 				} `json:"links"`
+				// Data identifies the comment's attachments when the
+				// response includes them. It is nil when the API left the
+				// linkage out, and empty when there are no attachments.
+				Data []ResourceIdentifier `json:"data,omitempty"`
 			} `json:"attachments"`
 		} `json:"relationships"`
 	} `json:"data"`
+	Included []IncludedResource `json:"included,omitempty"`
 }
 
-func getComment(commentID string) (Comment, error) {
-	url := fmt.Sprintf("https://api.regulations.gov/v4/comments/%s", commentID)
-	headers := map[string]string{"X-Api-Key": apiKey}
-	body, err := fetchJSON(url, headers)
+// ResourceIdentifier names a related JSONAPI resource.
+type ResourceIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// IncludedResource is an entry in the JSONAPI "included" array, returned when a
+// comment is requested with include=attachments.
+type IncludedResource struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	Attributes struct {
+		FileFormats []Attachment `json:"fileFormats"`
+	} `json:"attributes"`
+}
+
+func (c *APIClient) Comment(ctx context.Context, commentID string) (Comment, error) {
+	url := fmt.Sprintf("%s/comments/%s?include=attachments", c.baseURL, commentID)
+	body, err := c.fetchJSON(ctx, url, nil)
 	if err != nil {
 		return Comment{}, err
 	}
 
-	var c Comment
-	err = json.Unmarshal(body, &c)
+	var comment Comment
+	err = decodeJSON(url, body, &comment)
 	if err != nil {
 		return Comment{}, err
 	}
 
-	return c, nil
+	return comment, nil
 }
 
 // -------------------- attachments
 
 type Attachment struct {
 	FileURL string `json:"fileUrl"`
+	Format  string `json:"format"`
+	Size    int64  `json:"size"`
 }
 
 type AttachmentData struct {
 	Data []struct {
 		Attributes struct {
-			FileFormats []struct {
-				FileURL string `json:"fileUrl"`
-			} `json:"fileFormats"`
+			FileFormats []Attachment `json:"fileFormats"`
 		} `json:"attributes"`
 	} `json:"data"`
 }
 
-func getAttachments(attachmentURL string) ([]string, error) {
-	fmt.Printf("called getAttachments with attachmentURL: %s\n", attachmentURL)
-	headers := map[string]string{"X-Api-Key": apiKey}
-	body, err := fetchJSON(attachmentURL, headers)
+func attachmentURLs(files []Attachment) []string {
+	urls := make([]string, 0, len(files))
+	for _, file := range files {
+		urls = append(urls, file.FileURL)
+	}
+	return urls
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func (c *APIClient) Attachments(ctx context.Context, attachmentURL string) ([]Attachment, error) {
+	slog.Debug("fetching attachments", "url", attachmentURL)
+	body, err := c.fetchJSON(ctx, attachmentURL, nil)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("attachments: %s\n", body)
 
 	var data AttachmentData
-	err = json.Unmarshal(body, &data)
+	err = decodeJSON(attachmentURL, body, &data)
 	if err != nil {
 		return nil, err
 	}
 
-	var attachments []string
+	var formats [][]Attachment
 	for _, attachment := range data.Data {
-		for _, file := range attachment.Attributes.FileFormats {
-			attachments = append(attachments, file.FileURL)
-		}
+		formats = append(formats, attachment.Attributes.FileFormats)
 	}
+	attachments := uniqueAttachments(formats)
+	slog.Debug("fetched attachments", "url", attachmentURL, "count", len(attachments), "bytes", len(body))
 
 	return attachments, nil
 }
 
-// ---------------------- composite types for HTML
+// includedAttachments returns the attachments inlined in a comment's
+// "included" section. The second result is false when the response does not
+// account for all of the comment's attachments, in which case the related
+// link must be fetched. A comment whose relationship data lists no
+// attachments needs no further request.
+func includedAttachments(comment Comment) ([]Attachment, bool) {
+	included := make(map[string][]Attachment)
+	var formats [][]Attachment
+	for _, resource := range comment.Included {
+		if resource.Type == "attachments" {
+			included[resource.ID] = resource.Attributes.FileFormats
+			formats = append(formats, resource.Attributes.FileFormats)
+		}
+	}
 
-type CommentWithAttachments struct {
-	ID          string
-	Attachments []string
-	Comment     Comment
+	linkage := comment.Data.Relationships.Attachments.Data
+	if linkage == nil {
+		// Without relationship data, only a non-empty included section shows
+		// that the include was honored.
+		if len(formats) == 0 {
+			return nil, false
+		}
+		return uniqueAttachments(formats), true
+	}
+	formats = formats[:0]
+	for _, identifier := range linkage {
+		files, ok := included[identifier.ID]
+		if !ok {
+			return nil, false
+		}
+		formats = append(formats, files)
+	}
+	return uniqueAttachments(formats), true
 }
 
-type DocumentWithComments struct {
-	ObjectID string
-	Comments []CommentWithAttachments
+func uniqueAttachments(formats [][]Attachment) []Attachment {
+	var attachments []Attachment
+	seen := make(map[string]bool)
+	for _, files := range formats {
+		for _, file := range files {
+			if seen[file.FileURL] {
+				continue
+			}
+			seen[file.FileURL] = true
+			attachments = append(attachments, file)
+		}
+	}
+	return attachments
 }
 
-// --------------------- cache
+// -------------------- attachment mirroring
 
-type Cache struct {
-	comments map[string]CommentWithAttachments
-}
+const attachmentsDir = "attachments"
 
-func newCache() *Cache {
-	return &Cache{
-		comments: make(map[string]CommentWithAttachments),
+// attachmentFilename returns the decoded last path segment of an attachment
+// URL, without its query or fragment, for display. Use sanitizeFilename before
+// putting it on disk.
+func attachmentFilename(attachmentURL string) string {
+	var name string
+	if u, err := url.Parse(attachmentURL); err == nil {
+		// Split the escaped path, so that an encoded slash stays part of
+		// the name.
+		name = path.Base(u.EscapedPath())
+		if name == "." || name == "/" {
+			return ""
+		}
+	} else {
+		name = attachmentURL[strings.LastIndex(attachmentURL, "/")+1:]
+		if i := strings.IndexAny(name, "?#"); i >= 0 {
+			name = name[:i]
+		}
+	}
+	if decoded, err := url.PathUnescape(name); err == nil {
+		name = decoded
 	}
+	return name
 }
 
-func (c *Cache) updateComment(commentID string, commentWithAttachments CommentWithAttachments) {
-	c.comments[commentID] = commentWithAttachments
-	log.Printf("New comment added to cache: %s\n", commentID)
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "attachment"
+	}
+	return name
 }
 
-func (c *Cache) commentExists(commentID string) bool {
-	_, exists := c.comments[commentID]
-	if exists {
-		log.Printf("Comment %s already in cache\n", commentID)
+func uniqueFilename(name string, used map[string]bool) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
 	}
-	return exists
+	used[candidate] = true
+	return candidate
 }
 
-func updateCache(cache *Cache) {
-	documentIDs, err := getDocumentObjectIDs()
-	if err != nil {
-		log.Fatalf("Error getting documents: %v\n", err)
-	}
+var errAttachmentTooLarge = errors.New("attachment exceeds MAX_ATTACHMENT_BYTES")
 
-	for _, docID := range documentIDs {
-		commentIDs, err := rateLimitedRequest(500*time.Millisecond, getCommentIDs, docID)
-		if err != nil {
-			log.Fatalf("Error getting comment IDs for document %s: %v\n", docID, err)
-		}
+// FileValidator holds the cache validators a server returned with a
+// downloaded file, sent back on later downloads as conditional headers.
+type FileValidator struct {
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+}
 
-		for _, commentID := range commentIDs {
-			if !cache.commentExists(commentID) {
-				comment, err := getComment(commentID)
-				if err != nil {
-					log.Fatalf("Error getting comment %s: %v\n", commentID, err)
-				}
-				attachments, err := getAttachments(comment.Data.Relationships.Attachments.Links.Related)
-				if err != nil {
-					log.Fatalf("Error getting attachments for comment %s: %v\n", commentID, err)
+// downloadFile writes fileURL to path. If validator is non-empty the request
+// is conditional, and a 304 response leaves path untouched and reports
+// modified as false. It returns the validators of the response. The body is
+// streamed to disk rather than read into memory, since attachments can be large.
+func (c *APIClient) downloadFile(ctx context.Context, fileURL, path string, validator FileValidator, maxBytes int64) (FileValidator, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return validator, false, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if validator.ETag != "" {
+		req.Header.Set("If-None-Match", validator.ETag)
+	}
+	if validator.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validator.LastModified)
+	}
+	resp, err := c.downloadClient.Do(req)
+	if err != nil {
+		return validator, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return validator, false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return validator, false, &StatusError{URL: fileURL, StatusCode: resp.StatusCode}
+	}
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return validator, false, errAttachmentTooLarge
+	}
+
+	body := io.Reader(resp.Body)
+	if maxBytes > 0 {
+		// Read one byte past the limit to detect bodies longer than advertised.
+		body = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	// The file is only renamed into place once the whole body has arrived, so
+	// an interrupted download never leaves a truncated file at path, or
+	// clobbers the copy being revalidated.
+	err = writeFileAtomic(path, func(w io.Writer) error {
+		n, err := io.Copy(w, body)
+		if err == nil && maxBytes > 0 && n > maxBytes {
+			err = errAttachmentTooLarge
+		}
+		return err
+	})
+	received := FileValidator{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	return received, true, err
+}
+
+// mirroredFiles describes the result of mirroring one comment's attachments,
+// keyed by attachment URL.
+type mirroredFiles struct {
+	localFiles map[string]string
+	validators map[string]FileValidator
+	tooLarge   []string
+	// downloaded, unchanged, and failed count the files fetched, the files a
+	// conditional request found not modified, and the failed downloads.
+	downloaded int
+	unchanged  int
+	failed     int
+}
+
+// mirroredPaths records the local path of every mirrored attachment URL, so
+// that an attachment shared by several comments is only stored once. It is
+// shared by the mirroring workers, which claim a URL before downloading it so
+// that no two of them fetch the same file at once.
+type mirroredPaths struct {
+	mu    sync.Mutex
+	paths map[string]string
+	// pending holds a channel for each claimed URL, closed on release.
+	pending map[string]chan struct{}
+}
+
+func newMirroredPaths() *mirroredPaths {
+	return &mirroredPaths{
+		paths:   make(map[string]string),
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+func (m *mirroredPaths) get(attachment string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	relPath, ok := m.paths[attachment]
+	return relPath, ok
+}
+
+// claim returns the local path of attachment if it has been mirrored. If not,
+// it waits for any other worker's claim on the URL to be released, then claims
+// it for the caller, who must call release once done with it.
+func (m *mirroredPaths) claim(ctx context.Context, attachment string) (string, bool, error) {
+	for {
+		m.mu.Lock()
+		if relPath, ok := m.paths[attachment]; ok {
+			m.mu.Unlock()
+			return relPath, true, nil
+		}
+		released, claimed := m.pending[attachment]
+		if !claimed {
+			m.pending[attachment] = make(chan struct{})
+			m.mu.Unlock()
+			return "", false, nil
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		}
+	}
+}
+
+// release ends a claim on attachment, recording relPath as its local copy
+// unless it is empty because the attachment was not mirrored.
+func (m *mirroredPaths) release(attachment, relPath string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if relPath != "" {
+		m.paths[attachment] = relPath
+	}
+	close(m.pending[attachment])
+	delete(m.pending, attachment)
+}
+
+// downloadAttachments mirrors a comment's attachments into
+// <OutputDir>/attachments/<commentID>/ and returns the local path, relative to
+// OutputDir, and the validators for each attachment URL. Files already on disk
+// are revalidated with a conditional request when validators holds an entry for
+// them and are otherwise not fetched again. URLs present in seen reuse the
+// local path recorded there. Files over MaxAttachmentBytes are not kept and
+// are listed in tooLarge instead. A failed download does not stop the others;
+// the failures are returned together.
+func downloadAttachments(ctx context.Context, client *APIClient, cfg *Config, commentID string, attachments []string, validators map[string]FileValidator, seen *mirroredPaths) (mirroredFiles, error) {
+	mirrored := mirroredFiles{
+		localFiles: make(map[string]string),
+		validators: make(map[string]FileValidator),
+	}
+	relDir := filepath.Join(attachmentsDir, sanitizeFilename(commentID))
+	if err := os.MkdirAll(filepath.Join(cfg.OutputDir, relDir), 0755); err != nil {
+		return mirrored, err
+	}
+	// Temporary files left by a download that was killed midway.
+	partials, _ := filepath.Glob(filepath.Join(cfg.OutputDir, relDir, ".*.tmp"))
+	for _, partial := range partials {
+		slog.Debug("removing partial download", "path", partial)
+		os.Remove(partial)
+	}
+
+	// Reserve the names of files already mirrored for this comment, so that a
+	// new attachment with the same name is not mapped onto one of them.
+	used := make(map[string]bool)
+	for _, attachment := range attachments {
+		if relPath, ok := seen.get(attachment); ok && filepath.Dir(filepath.FromSlash(relPath)) == relDir {
+			used[filepath.Base(relPath)] = true
+		}
+	}
+	var errs []error
+	for _, attachment := range attachments {
+		if _, done := mirrored.localFiles[attachment]; done {
+			continue
+		}
+		relPath, ok, err := seen.claim(ctx, attachment)
+		if err != nil {
+			return mirrored, err
+		}
+		if ok {
+			mirrored.localFiles[attachment] = relPath
+			if validator, ok := validators[attachment]; ok {
+				mirrored.validators[attachment] = validator
+			}
+			continue
+		}
+
+		relPath = filepath.Join(relDir, uniqueFilename(sanitizeFilename(attachmentFilename(attachment)), used))
+		err = downloadAttachment(ctx, client, cfg, attachment, relPath, validators, &mirrored)
+		seen.release(attachment, mirrored.localFiles[attachment])
+		if err != nil {
+			if ctx.Err() != nil {
+				return mirrored, ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("downloading %s: %w", attachment, err))
+		}
+	}
+
+	mirrored.failed = len(errs)
+	return mirrored, errors.Join(errs...)
+}
+
+// downloadAttachment mirrors one attachment to relPath for downloadAttachments
+// and records the outcome in mirrored.
+func downloadAttachment(ctx context.Context, client *APIClient, cfg *Config, attachment, relPath string, validators map[string]FileValidator, mirrored *mirroredFiles) error {
+	path := filepath.Join(cfg.OutputDir, relPath)
+
+	validator, known := validators[attachment]
+	_, statErr := os.Stat(path)
+	if statErr != nil || known {
+		if statErr != nil {
+			validator = FileValidator{}
+		}
+		if err := client.downloads.Wait(ctx); err != nil {
+			return err
+		}
+		slog.Debug("downloading attachment", "url", attachment, "path", path, "conditional", validator != FileValidator{})
+		newValidator, modified, err := client.downloadFile(ctx, attachment, path, validator, cfg.MaxAttachmentBytes)
+		if errors.Is(err, errAttachmentTooLarge) {
+			os.Remove(path)
+			slog.Warn("attachment too large, linking to the original", "url", attachment, "limit", cfg.MaxAttachmentBytes)
+			mirrored.tooLarge = append(mirrored.tooLarge, attachment)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if modified {
+			metrics.attachmentsDownloaded.Add(1)
+			mirrored.downloaded++
+		} else {
+			slog.Debug("attachment not modified", "url", attachment)
+			mirrored.unchanged++
+		}
+		validator, known = newValidator, newValidator != FileValidator{}
+	}
+	mirrored.localFiles[attachment] = filepath.ToSlash(relPath)
+	if known {
+		mirrored.validators[attachment] = validator
+	}
+	return nil
+}
+
+// mirrorAttachments downloads the attachments of every cached comment that
+// is not fully mirrored yet, with a pool of MirrorConcurrency workers. The
+// workers share the client's download limiter, so concurrency overlaps slow
+// downloads without raising the request rate.
+func mirrorAttachments(ctx context.Context, client *APIClient, cfg *Config, cache *Cache) error {
+	comments := cache.snapshot()
+
+	seen := newMirroredPaths()
+	for _, comment := range comments {
+		for attachment, relPath := range comment.LocalFiles {
+			seen.paths[attachment] = relPath
+		}
+	}
+
+	jobs := make(chan CommentWithAttachments)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	var downloaded, unchanged, tooLarge, failed int
+
+	for i := 0; i < cfg.MirrorConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for comment := range jobs {
+				mirrored, err := downloadAttachments(ctx, client, cfg, comment.ID, comment.Attachments, comment.Validators, seen)
+				if len(mirrored.localFiles) > 0 || len(mirrored.tooLarge) > 0 {
+					cache.setMirroredFiles(comment.ID, mirrored)
 				}
-				commentWithAttachments := CommentWithAttachments{
-					ID:          commentID,
-					Attachments: attachments,
-					Comment:     comment,
+				mu.Lock()
+				downloaded += mirrored.downloaded
+				unchanged += mirrored.unchanged
+				tooLarge += len(mirrored.tooLarge)
+				failed += mirrored.failed
+				if err != nil && ctx.Err() == nil {
+					errs = append(errs, fmt.Errorf("mirroring attachments for comment %s: %w", comment.ID, err))
 				}
-				cache.updateComment(commentID, commentWithAttachments)
+				mu.Unlock()
 			}
+		}()
+	}
+
+feed:
+	for _, comment := range comments {
+		if len(comment.Attachments) == 0 || len(comment.LocalFiles)+len(comment.TooLarge) >= len(comment.Attachments) {
+			continue
+		}
+		select {
+		case jobs <- comment:
+		case <-ctx.Done():
+			break feed
 		}
 	}
-}
+	close(jobs)
+	wg.Wait()
 
-func printCache(cache *Cache) {
-	for commentID, comment := range cache.comments {
-		fmt.Printf("Comment %s:\n", commentID)
-		fmt.Printf("\tAttachments: %v\n", comment.Attachments)
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
+	slog.Info("attachment mirroring finished", "downloaded", downloaded, "unchanged", unchanged, "tooLarge", tooLarge, "failed", failed)
+	return errors.Join(errs...)
 }
 
-// ---------------------- HTML generation
+// ---------------------- composite types for HTML
+
+type CommentWithAttachments struct {
+	ID          string
+	DocketID    string
+	Attachments []string
+	// Files carries the format and size of each entry in Attachments.
+	Files      []Attachment      `json:",omitempty"`
+	LocalFiles map[string]string `json:",omitempty"`
+	// Validators records the ETag and Last-Modified of each mirrored file.
+	Validators map[string]FileValidator `json:",omitempty"`
+	// TooLarge lists attachments skipped for exceeding MaxAttachmentBytes.
+	TooLarge   []string `json:",omitempty"`
+	PostedDate time.Time
+	// LastModified is the lastModifiedDate reported by the comment listing
+	// when this entry was fetched, used to detect amended comments.
+	LastModified string `json:",omitempty"`
+	// ClusterKey is shared by comments whose text is identical after
+	// normalization; see clusterKey.
+	ClusterKey string `json:",omitempty"`
+	// RawEmail is the email address as submitted; Comment holds the
+	// normalized form. EmailValid reports whether that form parses as a
+	// bare address.
+	RawEmail   string `json:",omitempty"`
+	EmailValid bool
+	Comment    Comment
+}
 
-func generateHTML(cache *Cache) {
+// normalizeEmail trims and lowercases an email address and reports whether
+// the result is a single bare address.
+func normalizeEmail(raw string) (string, bool) {
+	email := strings.ToLower(strings.TrimSpace(raw))
+	if email == "" {
+		return "", false
+	}
+	addr, err := mail.ParseAddress(email)
+	return email, err == nil && addr.Address == email
+}
+
+// setEmail normalizes the commenter email, keeping the submitted value.
+func (c *CommentWithAttachments) setEmail() {
+	attributes := &c.Comment.Data.Attributes
+	c.RawEmail = attributes.Email
+	attributes.Email, c.EmailValid = normalizeEmail(attributes.Email)
+}
 
-	if err := os.MkdirAll("static", 0755); err != nil {
-		log.Fatalf("Error creating static directory: %v\n", err)
+// clusterKey hashes comment text after lowercasing it and collapsing
+// whitespace, so that mass-submitted copies of a form letter share a key.
+// Empty text has no key.
+func clusterKey(text string) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(text)), " ")
+	if normalized == "" {
+		return ""
 	}
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:16])
+}
 
-	file, err := os.Create(filepath.Join("static", "index.html"))
+func parsePostedDate(comment Comment) time.Time {
+	posted, err := time.Parse(time.RFC3339, comment.Data.Attributes.PostedDate)
 	if err != nil {
-		log.Fatalf("Error creating HTML file: %v\n", err)
+		return time.Time{}
 	}
-	defer file.Close()
+	return posted
+}
 
-	loc, err := time.LoadLocation("America/New_York")
+type DocumentWithComments struct {
+	ObjectID string
+	Comments []CommentWithAttachments
+}
+
+// ------------------------ metrics
+
+// metricsCounters holds the process-wide counters exported at /metrics.
+type metricsCounters struct {
+	apiRequests           atomic.Int64
+	apiFailures           atomic.Int64
+	commentsFetched       atomic.Int64
+	attachmentsDownloaded atomic.Int64
+	updates               atomic.Int64
+	updateFailures        atomic.Int64
+}
+
+var metrics metricsCounters
+
+// writeMetric writes one metric in the Prometheus text exposition format.
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// ------------------------ progress
+
+const progressLogEvery = 25
+
+type ProgressStatus struct {
+	DocketID string `json:"docketId"`
+	Done     int    `json:"done"`
+	Total    int    `json:"total"`
+}
+
+type progressTracker struct {
+	mu     sync.Mutex
+	status ProgressStatus
+	active bool
+}
+
+func (p *progressTracker) start(docketID string, total int) {
+	p.mu.Lock()
+	p.status = ProgressStatus{DocketID: docketID, Total: total}
+	p.active = total > 0
+	p.mu.Unlock()
+	if total > 0 {
+		slog.Info("fetching comments", "docket", docketID, "total", total)
+	}
+}
+
+func (p *progressTracker) advance() {
+	p.mu.Lock()
+	p.status.Done++
+	status := p.status
+	p.mu.Unlock()
+
+	if status.Done%progressLogEvery == 0 || status.Done == status.Total {
+		slog.Info(fmt.Sprintf("fetched %d/%d comments (%d%%)", status.Done, status.Total, status.Done*100/status.Total), "docket", status.DocketID)
+	}
+}
+
+func (p *progressTracker) finish() {
+	p.mu.Lock()
+	p.active = false
+	p.mu.Unlock()
+}
+
+func (p *progressTracker) snapshot() (ProgressStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status, p.active
+}
+
+// ------------------------ resume
+
+// resumeSaveEvery is how many fetched comments pass between checkpoints of the
+// resume file and the cache.
+const resumeSaveEvery = 25
+
+type resumeDocket struct {
+	Started time.Time   `json:"started"`
+	Pending []CommentID `json:"pending"`
+}
+
+// resumeTracker checkpoints the comments still to be fetched for each docket
+// so that an interrupted update can continue where it stopped. A nil tracker
+// disables resuming.
+type resumeTracker struct {
+	mu        sync.Mutex
+	path      string
+	cachePath string
+	dockets   map[string]*resumeDocket
+	completed map[string]bool
+	sinceSave int
+}
+
+func loadResumeTracker(path, cachePath string) (*resumeTracker, error) {
+	r := &resumeTracker{
+		path:      path,
+		cachePath: cachePath,
+		dockets:   make(map[string]*resumeDocket),
+		completed: make(map[string]bool),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
 	if err != nil {
-		log.Fatalf("Error loading EST time zone: %v\n", err)
+		return nil, err
 	}
+	if err := json.Unmarshal(data, &r.dockets); err != nil {
+		return nil, fmt.Errorf("decoding resume file %s: %w", path, err)
+	}
+	return r, nil
+}
 
-	lastUpdated := time.Now().In(loc).Format("2006-01-02 15:04:05 MST")
+func (r *resumeTracker) pending(docketID string) (resumeDocket, bool) {
+	if r == nil {
+		return resumeDocket{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, ok := r.dockets[docketID]
+	if !ok {
+		return resumeDocket{}, false
+	}
+	return *state, true
+}
 
-	html := fmt.Sprintf(`<html>
-<head>
-	<title>Comments</title>
-    <style>
-    table {
-      width: 100%%;
-      border-collapse: collapse;
-    }
+func (r *resumeTracker) begin(docketID string, started time.Time, pending []CommentID) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dockets[docketID] = &resumeDocket{Started: started, Pending: pending}
+	r.saveLocked()
+}
 
-    th, td {
-      border: 1px solid black;
-      padding: 8px;
-      text-align: left;
-    }
+func (r *resumeTracker) done(docketID, commentID string, cache *Cache) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.completed[commentID] = true
+	r.sinceSave++
+	if r.sinceSave < resumeSaveEvery {
+		return
+	}
+	// Save the cache first so a checkpoint never lists a comment as done
+	// before the comment itself is on disk.
+	if err := cache.saveCache(r.cachePath); err != nil {
+		slog.Error("error saving cache checkpoint", "path", r.cachePath, "error", err)
+		return
+	}
+	r.saveLocked()
+}
 
-    th {
-      background-color: #f2f2f2;
-    }
-    </style>
-    <script>
-    function copyTableToClipboard() {
-        var range = document.createRange();
-        range.selectNode(document.getElementById("commentsTable"));
-        window.getSelection().removeAllRanges();
-        window.getSelection().addRange(range);
-        document.execCommand("copy");
-        window.getSelection().removeAllRanges();
-        alert("Table copied to clipboard!");
-    }
-    </script>
-</head>
-<body>
-    <p><i>Data last updated: %s</i></p>
-    <button onclick="copyTableToClipboard()">Copy HTML Table to Clipboard</button>
-	<table id="commentsTable" border="1">
-		<tr>
-			<th>Comment URL</th>
-			<th>Attachments</th>
-			<th>First Name</th>
-			<th>Last Name</th>
-			<th>Email</th>
-			<th>Organization</th>
-		</tr><br><br>`, lastUpdated)
+func (r *resumeTracker) finish(docketID string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.dockets, docketID)
+	r.saveLocked()
+}
 
-	var commentList []CommentWithAttachments
-	for _, comment := range cache.comments {
-		commentList = append(commentList, comment)
+func (r *resumeTracker) saveLocked() {
+	r.sinceSave = 0
+	for _, state := range r.dockets {
+		var pending []CommentID
+		for _, commentID := range state.Pending {
+			if !r.completed[commentID.ID] {
+				pending = append(pending, commentID)
+			}
+		}
+		state.Pending = pending
 	}
+	r.completed = make(map[string]bool)
 
-	sort.Slice(commentList, func(i, j int) bool {
-		return commentList[i].Comment.Data.Links.Self < commentList[j].Comment.Data.Links.Self
-	})
+	if len(r.dockets) == 0 {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("error removing resume file", "path", r.path, "error", err)
+		}
+		return
+	}
+	data, err := json.Marshal(r.dockets)
+	if err == nil {
+		err = writeFileAtomic(r.path, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	if err != nil {
+		slog.Error("error saving resume file", "path", r.path, "error", err)
+	}
+}
 
-	for _, commentWithAttachments := range commentList {
-		comment := commentWithAttachments.Comment
-		commentURL := fmt.Sprintf("https://www.regulations.gov/comment/%s", comment.Data.ID)
-		html += fmt.Sprintf(`<tr>
-			<td><a href="%s">%s</a></td>
-			<td>`, commentURL, comment.Data.ID)
+// --------------------- cache
+
+type Cache struct {
+	mu                   sync.RWMutex
+	comments             map[string]CommentWithAttachments
+	lastSuccessfulUpdate time.Time
+	// watermarks records, per docket, when the last successful sync started.
+	watermarks map[string]time.Time
+	// documentLists holds the last document listing of each docket, reused
+	// when a conditional listing request is answered with 304.
+	documentLists map[string]documentList
+	// index maps each lowercased term in a comment body to the IDs of the
+	// comments containing it. It is rebuilt by rebuildIndex.
+	index map[string][]string
+	// recent holds the comments added by the most recent update.
+	recent recentAdditions
+	// progress tracks the comment fetches of the running update. It is
+	// neither persisted nor copied by replace.
+	progress progressTracker
+}
+
+type recentAdditions struct {
+	Updated    time.Time `json:"updated"`
+	CommentIDs []string  `json:"commentIds"`
+}
+
+func newCache() *Cache {
+	return &Cache{
+		comments:      make(map[string]CommentWithAttachments),
+		watermarks:    make(map[string]time.Time),
+		documentLists: make(map[string]documentList),
+		index:         make(map[string][]string),
+	}
+}
+
+type documentList struct {
+	FetchedAt time.Time
+	IDs       []string
+}
+
+func (c *Cache) updateComment(commentID string, commentWithAttachments CommentWithAttachments) {
+	c.mu.Lock()
+	previous, existed := c.comments[commentID]
+	if existed && commentWithAttachments.LocalFiles == nil {
+		// When a comment is amended, files with validators are left out of
+		// LocalFiles so that the next mirror pass revalidates them.
+		amended := previous.LastModified != commentWithAttachments.LastModified
 		for _, attachment := range commentWithAttachments.Attachments {
-			filename := attachment[strings.LastIndex(attachment, "/")+1:]
-			html += fmt.Sprintf(`<a href="%s">%s</a><br>`, attachment, filename)
+			validator, hasValidator := previous.Validators[attachment]
+			if hasValidator {
+				if commentWithAttachments.Validators == nil {
+					commentWithAttachments.Validators = make(map[string]FileValidator)
+				}
+				commentWithAttachments.Validators[attachment] = validator
+			}
+			if slices.Contains(previous.TooLarge, attachment) {
+				commentWithAttachments.TooLarge = append(commentWithAttachments.TooLarge, attachment)
+			}
+			if amended && hasValidator {
+				continue
+			}
+			if localFile, ok := previous.LocalFiles[attachment]; ok {
+				if commentWithAttachments.LocalFiles == nil {
+					commentWithAttachments.LocalFiles = make(map[string]string)
+				}
+				commentWithAttachments.LocalFiles[attachment] = localFile
+			}
 		}
-		html += fmt.Sprintf(`</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-		</tr>`, comment.Data.Attributes.FirstName, comment.Data.Attributes.LastName, comment.Data.Attributes.Email, comment.Data.Attributes.Organization)
 	}
+	c.comments[commentID] = commentWithAttachments
+	c.mu.Unlock()
 
-	html += `</table>
-</body>
-</html>`
+	if existed {
+		slog.Info("comment updated in cache", "comment", commentID)
+	} else {
+		slog.Info("new comment added to cache", "comment", commentID)
+	}
+}
 
-	_, err = file.WriteString(html)
-	if err != nil {
-		log.Fatalf("Error writing to HTML file: %v\n", err)
+// needsFetch reports whether a listed comment is missing from the cache or has
+// been modified since it was cached. Entries cached before modification dates
+// were tracked adopt the listed date rather than being refetched.
+func (c *Cache) needsFetch(commentID, lastModified string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, exists := c.comments[commentID]
+	if !exists {
+		return true
 	}
+	if cached.LastModified == "" {
+		cached.LastModified = lastModified
+		c.comments[commentID] = cached
+	} else if lastModified != "" && cached.LastModified != lastModified {
+		slog.Debug("comment modified since cached", "comment", commentID)
+		return true
+	}
+	slog.Debug("comment already in cache", "comment", commentID)
+	return false
+}
 
-	log.Println("HTML file generated successfully.")
+func (c *Cache) setMirroredFiles(commentID string, mirrored mirroredFiles) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	comment, ok := c.comments[commentID]
+	if !ok {
+		return
+	}
+	comment.LocalFiles = mirrored.localFiles
+	if len(mirrored.validators) > 0 {
+		comment.Validators = mirrored.validators
+	}
+	comment.TooLarge = mirrored.tooLarge
+	c.comments[commentID] = comment
 }
 
-// ---------------------- HTTP server
+func (c *Cache) markUpdated(t time.Time) {
+	c.mu.Lock()
+	c.lastSuccessfulUpdate = t
+	c.mu.Unlock()
+}
 
-func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "https://"+r.Host+r.RequestURI, http.StatusMovedPermanently)
+func (c *Cache) stats() (int, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.comments), c.lastSuccessfulUpdate
 }
 
-func startServerHTTPS() {
-	http.Handle("/", http.FileServer(http.Dir("static")))
-	log.Println("Starting HTTPS server on :443")
+func (c *Cache) watermark(docketID string) time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.watermarks[docketID]
+}
 
-	certFile := filepath.Join(certPath, "fullchain.pem")
-	keyFile := filepath.Join(certPath, "privkey.pem")
+func (c *Cache) setWatermark(docketID string, t time.Time) {
+	c.mu.Lock()
+	c.watermarks[docketID] = t
+	c.mu.Unlock()
+}
 
-	go func() {
-		log.Println("Redirecting HTTP to HTTPS on :80")
-		log.Fatal(http.ListenAndServe(":80", http.HandlerFunc(redirectToHTTPS)))
-	}()
+func (c *Cache) documentList(docketID string) (documentList, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	list, ok := c.documentLists[docketID]
+	return list, ok
+}
 
-	err := http.ListenAndServeTLS(":443", certFile, keyFile, nil)
-	if err != nil {
-		log.Fatalf("ListenAndServeTLS failed: %v", err)
+func (c *Cache) setDocumentList(docketID string, list documentList) {
+	c.mu.Lock()
+	c.documentLists[docketID] = list
+	c.mu.Unlock()
+}
+
+// commentIDs returns the set of cached comment IDs.
+func (c *Cache) commentIDs() map[string]bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make(map[string]bool, len(c.comments))
+	for id := range c.comments {
+		ids[id] = true
 	}
+	return ids
 }
 
-func startServer() {
-	http.Handle("/", http.FileServer(http.Dir("static")))
-	log.Println("Starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+// recordAdded records, sorted, the cached comment IDs missing from before as
+// the additions of the update that finished at t.
+func (c *Cache) recordAdded(before map[string]bool, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	added := []string{}
+	for id := range c.comments {
+		if !before[id] {
+			added = append(added, id)
+		}
+	}
+	sort.Strings(added)
+	c.recent = recentAdditions{Updated: t, CommentIDs: added}
 }
 
-// ---------------------- main
+// recentlyAdded returns the comments added by the most recent update.
+func (c *Cache) recentlyAdded() recentAdditions {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.recent
+}
 
-func main() {
-	cache := newCache()
-	apiKey = os.Getenv("API_KEY")
-	certPath = os.Getenv("CERT_PATH")
+func (c *Cache) replace(other *Cache) {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.comments = other.comments
+	c.watermarks = other.watermarks
+	c.documentLists = other.documentLists
+	c.index = other.index
+	c.lastSuccessfulUpdate = other.lastSuccessfulUpdate
+	c.recent = other.recent
+}
 
-	go func() {
-		for {
-			updateCache(cache)
-			generateHTML(cache)
-			time.Sleep(5 * time.Minute)
+// searchTerms splits text into unique lowercased runs of letters and digits.
+func searchTerms(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool, len(fields))
+	terms := fields[:0]
+	for _, field := range fields {
+		if !seen[field] {
+			seen[field] = true
+			terms = append(terms, field)
 		}
-	}()
+	}
+	return terms
+}
+
+func (c *Cache) rebuildIndex() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	index := make(map[string][]string)
+	for id, comment := range c.comments {
+		for _, term := range searchTerms(comment.Comment.Data.Attributes.Comment) {
+			index[term] = append(index[term], id)
+		}
+	}
+	c.index = index
+	slog.Debug("rebuilt search index", "comments", len(c.comments), "terms", len(index))
+}
+
+// search returns the cached comments whose bodies contain every term in query.
+func (c *Cache) search(query string) []CommentWithAttachments {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	matches := make(map[string]bool)
+	for _, id := range c.index[terms[0]] {
+		matches[id] = true
+	}
+	for _, term := range terms[1:] {
+		next := make(map[string]bool)
+		for _, id := range c.index[term] {
+			if matches[id] {
+				next[id] = true
+			}
+		}
+		matches = next
+	}
+
+	results := make([]CommentWithAttachments, 0, len(matches))
+	for id := range matches {
+		if comment, ok := c.comments[id]; ok {
+			results = append(results, comment)
+		}
+	}
+	return results
+}
+
+func (c *Cache) snapshot() []CommentWithAttachments {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	comments := make([]CommentWithAttachments, 0, len(c.comments))
+	for _, comment := range c.comments {
+		comments = append(comments, comment)
+	}
+	return comments
+}
+
+const cacheSchemaVersion = 1
+
+type cacheFile struct {
+	SchemaVersion int                               `json:"schemaVersion"`
+	Comments      map[string]CommentWithAttachments `json:"comments"`
+	Watermarks    map[string]time.Time              `json:"watermarks,omitempty"`
+	DocumentLists map[string]documentList           `json:"documentLists,omitempty"`
+	// LastSuccessfulUpdate and Recent are saved so that a serve-only process
+	// can report on the updates another process runs.
+	LastSuccessfulUpdate time.Time       `json:"lastSuccessfulUpdate"`
+	Recent               recentAdditions `json:"recent"`
+}
+
+func (c *Cache) saveCache(path string) error {
+	c.mu.RLock()
+	data, err := json.Marshal(cacheFile{
+		SchemaVersion:        cacheSchemaVersion,
+		Comments:             c.comments,
+		Watermarks:           c.watermarks,
+		DocumentLists:        c.documentLists,
+		LastSuccessfulUpdate: c.lastSuccessfulUpdate,
+		Recent:               c.recent,
+	})
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func loadCache(path string) (*Cache, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newCache(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file cacheFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	if file.SchemaVersion != cacheSchemaVersion {
+		return nil, fmt.Errorf("cache %s has schema version %d, expected %d", path, file.SchemaVersion, cacheSchemaVersion)
+	}
+
+	cache := newCache()
+	for id, comment := range file.Comments {
+		if comment.PostedDate.IsZero() {
+			comment.PostedDate = parsePostedDate(comment.Comment)
+		}
+		if comment.ClusterKey == "" {
+			comment.ClusterKey = clusterKey(comment.Comment.Data.Attributes.Comment)
+		}
+		if comment.RawEmail == "" {
+			comment.setEmail()
+		}
+		cache.comments[id] = comment
+	}
+	for docketID, t := range file.Watermarks {
+		cache.watermarks[docketID] = t
+	}
+	for docketID, list := range file.DocumentLists {
+		cache.documentLists[docketID] = list
+	}
+	cache.lastSuccessfulUpdate = file.LastSuccessfulUpdate
+	cache.recent = file.Recent
+	cache.rebuildIndex()
+	slog.Info("loaded cache", "path", path, "comments", len(cache.comments))
+	return cache, nil
+}
+
+// moveAside renames a file that could not be loaded to
+// <path>.bad-<timestamp>, so that it is kept for inspection rather than
+// overwritten, and returns the new name.
+func moveAside(path string, now time.Time) (string, error) {
+	moved := path + ".bad-" + now.UTC().Format("20060102T150405Z")
+	if err := os.Rename(path, moved); err != nil {
+		return "", err
+	}
+	return moved, nil
+}
+
+// monitoredDockets returns the configured docket IDs plus, in agency mode,
+// every docket currently listed for the agency.
+func monitoredDockets(ctx context.Context, client *APIClient, cfg *Config) ([]string, error) {
+	if cfg.AgencyID == "" {
+		return cfg.DocketIDs, nil
+	}
+	agencyDockets, err := client.AgencyDocketIDs(ctx, cfg.AgencyID)
+	if err != nil {
+		return nil, fmt.Errorf("getting dockets for agency %s: %w", cfg.AgencyID, err)
+	}
+	slog.Info("found agency dockets", "agency", cfg.AgencyID, "dockets", len(agencyDockets))
+
+	seen := make(map[string]bool)
+	var dockets []string
+	for _, docketID := range append(append([]string{}, cfg.DocketIDs...), agencyDockets...) {
+		if !seen[docketID] {
+			seen[docketID] = true
+			dockets = append(dockets, docketID)
+		}
+	}
+	return dockets, nil
+}
+
+func updateCache(ctx context.Context, client *APIClient, cfg *Config, cache *Cache, resume *resumeTracker) error {
+	metrics.updates.Add(1)
+	defer cache.rebuildIndex()
+	before := cache.commentIDs()
+	defer func() { cache.recordAdded(before, time.Now()) }()
+	dockets, err := monitoredDockets(ctx, client, cfg)
+	if err != nil {
+		metrics.updateFailures.Add(1)
+		return err
+	}
+
+	var errs []error
+	for _, docketID := range dockets {
+		err := updateDocket(ctx, client, cfg, cache, resume, docketID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("updating docket %s: %w", docketID, err))
+		}
+	}
+
+	if cfg.Mirror {
+		if err := mirrorAttachments(ctx, client, cfg, cache); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		metrics.updateFailures.Add(1)
+		return errors.Join(errs...)
+	}
+	cache.markUpdated(time.Now())
+	return nil
+}
+
+// listDocketComments lists the comments on every document in a docket and
+// returns the number of documents, the unique listed comments, and the subset
+// that is missing from or stale in the cache.
+func listDocketComments(ctx context.Context, api CommentSource, cfg *Config, cache *Cache, docketID string) (int, []CommentID, []CommentID, error) {
+	since := cache.watermark(docketID)
+
+	previous, listedBefore := cache.documentList(docketID)
+	var modifiedSince time.Time
+	if listedBefore {
+		modifiedSince = previous.FetchedAt
+	}
+	fetchedAt := time.Now()
+	documentIDs, err := api.DocumentObjectIDs(ctx, docketID, modifiedSince)
+	switch {
+	case errors.Is(err, errNotModified):
+		slog.Debug("document list not modified", "docket", docketID, "since", modifiedSince)
+		documentIDs = previous.IDs
+	case err != nil:
+		return 0, nil, nil, fmt.Errorf("getting documents: %w", err)
+	default:
+		cache.setDocumentList(docketID, documentList{FetchedAt: fetchedAt, IDs: documentIDs})
+	}
+	if len(documentIDs) == 0 {
+		slog.Warn("no documents found for docket; check that the docket ID is correct", "docket", docketID)
+	}
+
+	var listed []CommentID
+	for _, docID := range documentIDs {
+		commentIDs, err := api.CommentIDs(ctx, docID, since, cfg.PostedStart, cfg.PostedEnd)
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("getting comment IDs for document %s: %w", docID, err)
+		}
+		listed = append(listed, commentIDs...)
+	}
+	listed = uniqueCommentIDs(listed)
+
+	var missing []CommentID
+	for _, commentID := range listed {
+		if cache.needsFetch(commentID.ID, commentID.Attributes.LastModifiedDate) {
+			missing = append(missing, commentID)
+		}
+	}
+	return len(documentIDs), listed, missing, nil
+}
+
+func updateDocket(ctx context.Context, api CommentSource, cfg *Config, cache *Cache, resume *resumeTracker, docketID string) error {
+	started := time.Now()
+
+	var missing []CommentID
+	if state, ok := resume.pending(docketID); ok {
+		slog.Info("resuming interrupted update", "docket", docketID, "remaining", len(state.Pending))
+		started = state.Started
+		missing = state.Pending
+	} else {
+		_, _, listedMissing, err := listDocketComments(ctx, api, cfg, cache, docketID)
+		if err != nil {
+			return err
+		}
+		missing = listedMissing
+		resume.begin(docketID, started, missing)
+	}
+
+	if err := fetchComments(ctx, api, cfg, cache, resume, docketID, missing); err != nil {
+		return err
+	}
+
+	cache.setWatermark(docketID, started.Add(-watermarkOverlap))
+	resume.finish(docketID)
+	return nil
+}
+
+// uniqueCommentIDs drops repeated IDs, keeping the first occurrence so that
+// comments listed under several documents are only fetched once.
+func uniqueCommentIDs(commentIDs []CommentID) []CommentID {
+	seen := make(map[string]bool, len(commentIDs))
+	var unique []CommentID
+	for _, commentID := range commentIDs {
+		if seen[commentID.ID] {
+			continue
+		}
+		seen[commentID.ID] = true
+		unique = append(unique, commentID)
+	}
+	return unique
+}
+
+// fetchComments fetches commentIDs with a pool of FetchConcurrency workers.
+// Every request goes through the client's rate limiter, so the combined request
+// rate is the same regardless of concurrency.
+func fetchComments(ctx context.Context, api CommentSource, cfg *Config, cache *Cache, resume *resumeTracker, docketID string, commentIDs []CommentID) error {
+	jobs := make(chan CommentID)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	cache.progress.start(docketID, len(commentIDs))
+	defer cache.progress.finish()
+
+	for i := 0; i < cfg.FetchConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for commentID := range jobs {
+				err := fetchComment(ctx, api, cache, docketID, commentID)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				} else {
+					resume.done(docketID, commentID.ID, cache)
+				}
+				cache.progress.advance()
+			}
+		}()
+	}
+
+feed:
+	for _, commentID := range commentIDs {
+		select {
+		case jobs <- commentID:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
+
+func fetchComment(ctx context.Context, api CommentSource, cache *Cache, docketID string, listed CommentID) error {
+	commentID := listed.ID
+	comment, err := api.Comment(ctx, commentID)
+	if err != nil {
+		return fmt.Errorf("getting comment %s: %w", commentID, err)
+	}
+
+	attachments, ok := includedAttachments(comment)
+	if !ok {
+		attachments = []Attachment{}
+		if related := comment.Data.Relationships.Attachments.Links.Related; related != "" {
+			attachments, err = api.Attachments(ctx, related)
+			if err != nil {
+				return fmt.Errorf("getting attachments for comment %s: %w", commentID, err)
+			}
+		}
+	}
+	// The attachments are kept in Files; don't store them twice.
+	comment.Included = nil
+
+	commentWithAttachments := CommentWithAttachments{
+		ID:           commentID,
+		DocketID:     docketID,
+		Attachments:  attachmentURLs(attachments),
+		Files:        attachments,
+		PostedDate:   parsePostedDate(comment),
+		LastModified: listed.Attributes.LastModifiedDate,
+		ClusterKey:   clusterKey(comment.Data.Attributes.Comment),
+		Comment:      comment,
+	}
+	commentWithAttachments.setEmail()
+	cache.updateComment(commentID, commentWithAttachments)
+	metrics.commentsFetched.Add(1)
+	return nil
+}
+
+func withAttachments(comments []CommentWithAttachments) []CommentWithAttachments {
+	var filtered []CommentWithAttachments
+	for _, comment := range comments {
+		if len(comment.Attachments) > 0 {
+			filtered = append(filtered, comment)
+		}
+	}
+	return filtered
+}
+
+// redactEmail masks all but the first character of an email's local part,
+// e.g. j***@example.com.
+func redactEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "***"
+	}
+	first, _ := utf8.DecodeRuneInString(email)
+	return string(first) + "***" + email[at:]
+}
+
+// publishable applies the output filters and redactions to comments taken
+// from the cache. The cache itself keeps the full data.
+func publishable(cfg *Config, comments []CommentWithAttachments) []CommentWithAttachments {
+	if cfg.OnlyWithAttachments {
+		comments = withAttachments(comments)
+	}
+	if cfg.RedactEmails {
+		for i := range comments {
+			attributes := &comments[i].Comment.Data.Attributes
+			attributes.Email = redactEmail(attributes.Email)
+			comments[i].RawEmail = redactEmail(comments[i].RawEmail)
+		}
+	}
+	return comments
+}
+
+// publishedComments returns the cached comments that should appear in the
+// generated outputs.
+func publishedComments(cfg *Config, cache *Cache) []CommentWithAttachments {
+	return publishable(cfg, cache.snapshot())
+}
+
+func printCache(cache *Cache) {
+	for _, comment := range cache.snapshot() {
+		fmt.Printf("Comment %s:\n", comment.ID)
+		fmt.Printf("\tAttachments: %v\n", comment.Attachments)
+	}
+}
+
+// ---------------------- HTML generation
+
+const commentPreviewLength = 300
+
+// seeAttachedPattern matches comment text that defers to an attachment, such
+// as "See attached file(s)" or "Please see the attached comments".
+var seeAttachedPattern = regexp.MustCompile(`(?i)\b(see|refer to|find)\b.{0,20}\battach(ed|ment|ments)\b`)
+
+// seeAttachedMaxLength bounds the text checked against seeAttachedPattern, so
+// that long comments mentioning an attachment in passing are not affected.
+const seeAttachedMaxLength = 200
+
+// refersToAttachment reports whether a comment's text is only a pointer to
+// its attachments.
+func refersToAttachment(text string) bool {
+	text = strings.TrimSpace(text)
+	return len(text) <= seeAttachedMaxLength && seeAttachedPattern.MatchString(text)
+}
+
+const rowsPerPage = 100
+
+const indexHTML = `<html>
+<head>
+	<title>{{.Title}}</title>
+    <style>
+    :root {
+      color-scheme: light;
+      --background: #ffffff;
+      --text: #000000;
+      --border: #000000;
+      --header-background: #f2f2f2;
+      --link: #0645ad;
+    }
+
+    @media (prefers-color-scheme: dark) {
+      :root:not([data-theme=light]) {
+        color-scheme: dark;
+        --background: #121212;
+        --text: #e0e0e0;
+        --border: #555555;
+        --header-background: #2a2a2a;
+        --link: #8ab4f8;
+      }
+    }
+
+    :root[data-theme=dark] {
+      color-scheme: dark;
+      --background: #121212;
+      --text: #e0e0e0;
+      --border: #555555;
+      --header-background: #2a2a2a;
+      --link: #8ab4f8;
+    }
+
+    body {
+      background-color: var(--background);
+      color: var(--text);
+    }
+
+    a {
+      color: var(--link);
+    }
+
+    table {
+      width: 100%;
+      border-collapse: collapse;
+    }
+
+    th, td {
+      border: 1px solid var(--border);
+      padding: 8px;
+      text-align: left;
+    }
+
+    th {
+      background-color: var(--header-background);
+    }
+
+    th.sortable {
+      cursor: pointer;
+    }
+    </style>
+    <script>
+    // Apply a saved theme before the page renders; without one, the
+    // stylesheet follows prefers-color-scheme.
+    try {
+        var savedTheme = localStorage.getItem("theme");
+        if (savedTheme) {
+            document.documentElement.setAttribute("data-theme", savedTheme);
+        }
+    } catch (e) {}
+
+    function toggleTheme() {
+        var root = document.documentElement;
+        var theme = root.getAttribute("data-theme");
+        var dark = theme ? theme === "dark" : window.matchMedia("(prefers-color-scheme: dark)").matches;
+        theme = dark ? "light" : "dark";
+        root.setAttribute("data-theme", theme);
+        try {
+            localStorage.setItem("theme", theme);
+        } catch (e) {}
+    }
+
+    function showCopyStatus(message) {
+        var status = document.getElementById("copyStatus");
+        status.textContent = message;
+        clearTimeout(status.timer);
+        status.timer = setTimeout(function() {
+            status.textContent = "";
+        }, 4000);
+    }
+
+    // copyWithSelection is the fallback for browsers without the Clipboard
+    // API, or pages not served over HTTPS.
+    function copyWithSelection(node) {
+        var range = document.createRange();
+        range.selectNode(node);
+        window.getSelection().removeAllRanges();
+        window.getSelection().addRange(range);
+        var copied = document.execCommand("copy");
+        window.getSelection().removeAllRanges();
+        return copied ? Promise.resolve() : Promise.reject(new Error("copy command was rejected"));
+    }
+
+    // tableText serializes every row of the table, including rows hidden by
+    // filtering and paging, with tab-separated cells.
+    function tableText(table) {
+        return Array.prototype.map.call(table.rows, function(row) {
+            return Array.prototype.map.call(row.cells, function(cell) {
+                return tsvField(cell.textContent);
+            }).join("\t");
+        }).join("\n");
+    }
+
+    function copyText(text) {
+        if (navigator.clipboard) {
+            return navigator.clipboard.writeText(text);
+        }
+        var textarea = document.createElement("textarea");
+        textarea.value = text;
+        document.body.appendChild(textarea);
+        var copied = copyWithSelection(textarea);
+        document.body.removeChild(textarea);
+        return copied;
+    }
+
+    // tsvField flattens a value onto one line so every comment stays on one
+    // spreadsheet row.
+    function tsvField(text) {
+        return text.trim().replace(/\s+/g, " ");
+    }
+
+    // copyTableAsTSV copies the key columns of the comments matching the
+    // filter as tab-separated values, which paste cleanly into spreadsheets.
+    function copyTableAsTSV() {
+        var lines = [["Comment ID", "URL", "Docket", "Posted", "First Name", "Last Name", "Email", "Organization", "Comment"].join("\t")];
+        var rows = document.querySelectorAll("#commentsTable tbody tr");
+        Array.prototype.forEach.call(rows, function(row) {
+            if (row.getAttribute("data-match") === "0") {
+                return;
+            }
+            var cells = row.cells;
+            var link = cells[1].querySelector("a");
+            var comment = row.querySelector(".comment-text");
+            lines.push([
+                link.textContent, link.href, cells[0].textContent, cells[2].textContent,
+                cells[4].textContent, cells[5].textContent, cells[6].textContent, cells[7].textContent,
+                comment ? comment.textContent : ""
+            ].map(tsvField).join("\t"));
+        });
+        copyText(lines.join("\n") + "\n").then(function() {
+            showCopyStatus((lines.length - 1) + " comments copied as TSV.");
+        }, function(err) {
+            showCopyStatus("Copy failed: " + err.message);
+        });
+    }
+
+    function copyTableToClipboard() {
+        var table = document.getElementById("commentsTable");
+        var copy;
+        if (navigator.clipboard && window.ClipboardItem) {
+            copy = navigator.clipboard.write([new ClipboardItem({
+                "text/html": new Blob([table.outerHTML], {type: "text/html"}),
+                "text/plain": new Blob([tableText(table)], {type: "text/plain"})
+            })]);
+        } else if (navigator.clipboard) {
+            copy = copyText(tableText(table));
+        } else {
+            copy = copyWithSelection(table);
+        }
+        copy.then(function() {
+            showCopyStatus("Table copied to clipboard.");
+        }, function(err) {
+            showCopyStatus("Copy failed: " + err.message);
+        });
+    }
+
+    var pageSize = {{.PageSize}};
+    var currentPage = 0;
+
+    function filterRows() {
+        var query = document.getElementById("filter").value.toLowerCase();
+        var stateFilter = document.getElementById("stateFilter");
+        var state = stateFilter ? stateFilter.value : "";
+        var rows = document.querySelectorAll("#commentsTable tbody tr");
+        rows.forEach(function(row) {
+            var text = Array.prototype.map.call(row.querySelectorAll(".filterable"), function(cell) {
+                return cell.textContent.toLowerCase();
+            }).join(" ");
+            var matches = (query === "" || text.indexOf(query) !== -1) &&
+                (state === "" || row.getAttribute("data-state") === state);
+            row.setAttribute("data-match", matches ? "1" : "0");
+        });
+        currentPage = 0;
+        renderPage();
+    }
+
+    function renderPage() {
+        var rows = Array.prototype.slice.call(document.querySelectorAll("#commentsTable tbody tr"));
+        var matching = rows.filter(function(row) {
+            return row.getAttribute("data-match") !== "0";
+        });
+        var pages = Math.max(1, Math.ceil(matching.length / pageSize));
+        currentPage = Math.min(Math.max(currentPage, 0), pages - 1);
+        var first = currentPage * pageSize;
+        rows.forEach(function(row) {
+            row.style.display = "none";
+        });
+        matching.slice(first, first + pageSize).forEach(function(row) {
+            row.style.display = "";
+        });
+        document.getElementById("visibleCount").textContent = matching.length + " of " + rows.length + " comments match";
+        document.getElementById("pageInfo").textContent = "Page " + (currentPage + 1) + " of " + pages;
+        document.getElementById("prevPage").disabled = currentPage === 0;
+        document.getElementById("nextPage").disabled = currentPage >= pages - 1;
+    }
+
+    function changePage(delta) {
+        currentPage += delta;
+        renderPage();
+    }
+
+    var sortKey = {{.SortKey}};
+    var sortDescending = {{.SortDescending}};
+    function sortBy(header, key, column) {
+        var tbody = document.querySelector("#commentsTable tbody");
+        var rows = Array.prototype.slice.call(tbody.rows);
+        sortDescending = key === sortKey ? !sortDescending : false;
+        sortKey = key;
+        function value(row) {
+            var cell = row.cells[column];
+            return cell.getAttribute("data-sort") || cell.textContent.toLowerCase();
+        }
+        rows.sort(function(a, b) {
+            var x = value(a);
+            var y = value(b);
+            return sortDescending ? y.localeCompare(x) : x.localeCompare(y);
+        });
+        rows.forEach(function(row) {
+            tbody.appendChild(row);
+        });
+        document.querySelectorAll("#commentsTable th.sortable span").forEach(function(arrow) {
+            arrow.textContent = "";
+        });
+        header.querySelector("span").textContent = sortDescending ? "▼" : "▲";
+        renderPage();
+    }
+
+    var filterTimer;
+    function scheduleFilter() {
+        clearTimeout(filterTimer);
+        filterTimer = setTimeout(filterRows, 200);
+    }
+
+    document.addEventListener("DOMContentLoaded", filterRows);
+    </script>
+</head>
+<body>
+    <h1>{{.Title}}</h1>
+    {{- with .Description}}
+    <p>{{.}}</p>
+    {{- end}}
+    <p><i>Data last updated: {{.LastUpdated}}</i></p>
+    <p>
+        <b>{{.Stats.Comments}}</b> comments,
+        <b>{{.Stats.WithAttachments}}</b> with attachments,
+        <b>{{.Stats.Attachments}}</b> attachments in total
+    </p>
+    {{- if .Root}}
+    <p><a href="{{.Root}}index.html">All dockets</a></p>
+    {{- end}}
+    <button onclick="toggleTheme()">Toggle dark mode</button>
+    <button onclick="copyTableToClipboard()">Copy HTML Table to Clipboard</button>
+    <button onclick="copyTableAsTSV()">Copy as TSV for Spreadsheets</button>
+    <span id="copyStatus" role="status"></span>
+    <a href="{{.Root}}comments.csv">Download CSV</a>
+    <a href="{{.Root}}comments.jsonl">Download JSON lines</a>
+    <a href="{{.Root}}organizations.html">Comments by organization</a>
+    {{- range .EmptyDockets}}
+    <p><b>No documents found for docket {{.}}.</b> Check that the docket ID is correct; a new docket may not have documents yet.</p>
+    {{- end}}
+    <p>
+        <input id="filter" type="search" placeholder="Filter by name, organization, or email" oninput="scheduleFilter()">
+        {{- if .ShowLocation}}
+        <select id="stateFilter" onchange="filterRows()">
+            <option value="">All states</option>
+            {{- range .States}}
+            <option value="{{.State}}">{{.State}} ({{.Comments}})</option>
+            {{- end}}
+        </select>
+        {{- end}}
+        <span id="visibleCount"></span>
+    </p>
+	<table id="commentsTable" border="1">
+		<thead>
+		<tr>
+			<th>Docket</th>
+			<th>Comment URL</th>
+			<th class="sortable" onclick="sortBy(this, 'posted', 2)">Posted <span>{{.Arrow "posted"}}</span></th>
+			<th>Attachments</th>
+			<th>First Name</th>
+			<th class="sortable" onclick="sortBy(this, 'lastname', 5)">Last Name <span>{{.Arrow "lastname"}}</span></th>
+			<th>Email</th>
+			<th class="sortable" onclick="sortBy(this, 'organization', 7)">Organization <span>{{.Arrow "organization"}}</span></th>
+			{{- if .ShowLocation}}
+			<th>Location</th>
+			{{- end}}
+			{{- if .ShowSubmitterType}}
+			<th>Submitter Type</th>
+			{{- end}}
+			{{- if .ShowGovAgency}}
+			<th>Government Agency</th>
+			{{- end}}
+			<th>Comment</th>
+			{{- if .ShowAPILinks}}
+			<th>API Link</th>
+			{{- end}}
+		</tr>
+		</thead>
+		<tbody>
+		{{- range .Comments}}
+		<tr{{if $.ShowLocation}} data-state="{{.State}}"{{end}}>
+			<td>{{.DocketID}}</td>
+			<td><a href="{{.URL}}">{{.ID}}</a></td>
+			<td data-sort="{{.PostedSort}}">{{.Posted}}</td>
+			<td>{{range .Attachments}}<a href="{{.URL}}">{{.Name}}</a>{{with .Label}} {{.}}{{end}}{{if .TooLarge}} <i>too large — external link</i>{{end}}<br>{{end}}</td>
+			<td class="filterable">{{.FirstName}}</td>
+			<td class="filterable">{{.LastName}}</td>
+			<td class="filterable">{{.Email}}{{if .InvalidEmail}} <i>(invalid)</i>{{end}}</td>
+			<td class="filterable">{{.Organization}}</td>
+			{{- if $.ShowLocation}}
+			<td class="filterable">{{.Location}}</td>
+			{{- end}}
+			{{- if $.ShowSubmitterType}}
+			<td>{{.SubmitterType}}</td>
+			{{- end}}
+			{{- if $.ShowGovAgency}}
+			<td>{{.GovAgency}}</td>
+			{{- end}}
+			<td class="comment">{{if .Truncated}}<details><summary>{{.CommentPreview}} <i>show more</i></summary><span class="comment-text">{{.Comment}}</span></details>{{else}}<span class="comment-text">{{.Comment}}</span>{{end}}{{with .FullCommentURL}}<br><a href="{{.}}">Full comment (attachment)</a>{{end}}{{if .Duplicates}}<br><i>+{{.Duplicates}} identical comments</i>{{end}}</td>
+			{{- if $.ShowAPILinks}}
+			<td>{{with .APILink}}<a href="{{.}}">{{.}}</a>{{end}}</td>
+			{{- end}}
+		</tr>
+		{{- end}}
+		</tbody>
+	</table>
+    <p>
+        <button id="prevPage" onclick="changePage(-1)">Previous</button>
+        <span id="pageInfo"></span>
+        <button id="nextPage" onclick="changePage(1)">Next</button>
+    </p>
+</body>
+</html>
+`
+
+var indexTemplate = template.Must(template.New("index").Parse(indexHTML))
+
+const docketsHTML = `<html>
+<head>
+	<title>{{.Title}}</title>
+</head>
+<body>
+    <h1>{{.Title}}</h1>
+    {{- with .Description}}
+    <p>{{.}}</p>
+    {{- end}}
+    <p><i>Data last updated: {{.LastUpdated}}</i></p>
+    <p>
+        <b>{{.Stats.Comments}}</b> comments,
+        <b>{{.Stats.WithAttachments}}</b> with attachments,
+        <b>{{.Stats.Attachments}}</b> attachments in total
+    </p>
+    <ul>
+        {{- range .Dockets}}
+        <li><a href="{{.DocketID}}/">{{.DocketID}}</a>: {{.Comments}} comments, {{.WithAttachments}} with attachments, {{.Attachments}} attachments</li>
+        {{- end}}
+    </ul>
+    <a href="comments.csv">Download CSV</a>
+    <a href="comments.jsonl">Download JSON lines</a>
+    <a href="organizations.html">Comments by organization</a>
+</body>
+</html>
+`
+
+var docketsTemplate = template.Must(template.New("dockets").Parse(docketsHTML))
+
+type docketsPage struct {
+	Title       string
+	Description string
+	LastUpdated string
+	Stats       commentStats
+	Dockets     []commentStats
+}
+
+type attachmentLink struct {
+	URL      string
+	Name     string
+	Label    string
+	TooLarge bool
+}
+
+type commentRow struct {
+	DocketID       string
+	ID             string
+	URL            string
+	Posted         string
+	PostedSort     string
+	Attachments    []attachmentLink
+	FirstName      string
+	LastName       string
+	Email          string
+	Organization   string
+	InvalidEmail   bool
+	Location       string
+	State          string
+	SubmitterType  string
+	GovAgency      string
+	Comment        string
+	CommentPreview string
+	Truncated      bool
+	// Duplicates counts the other comments collapsed into this row by -cluster.
+	Duplicates int
+	// APILink is the comment's regulations.gov API resource; see -api-links.
+	APILink string
+	// FullCommentURL links the attachment holding the comment when the text
+	// only refers to it; see -see-attached.
+	FullCommentURL string
+}
+
+type stateCount struct {
+	State    string
+	Comments int
+}
+
+type commentStats struct {
+	DocketID        string
+	Comments        int
+	WithAttachments int
+	Attachments     int
+}
+
+func (s *commentStats) add(comment CommentWithAttachments) {
+	s.Comments++
+	if len(comment.Attachments) > 0 {
+		s.WithAttachments++
+		s.Attachments += len(comment.Attachments)
+	}
+}
+
+type indexPage struct {
+	Title       string
+	Description string
+	LastUpdated string
+	DocketID    string
+	Root        string
+	PageSize    int
+	Stats       commentStats
+	Comments    []commentRow
+	// EmptyDockets lists the dockets whose last listing returned no documents.
+	EmptyDockets []string
+	// ShowLocation adds the Location column and a filter over States, which
+	// counts the comments from each state.
+	ShowLocation bool
+	States       []stateCount
+	ShowAPILinks bool
+	// ShowSubmitterType and ShowGovAgency hide those columns when no comment
+	// on the page has them.
+	ShowSubmitterType bool
+	ShowGovAgency     bool
+	// SortKey and SortDescending describe the order the rows were written in.
+	SortKey        string
+	SortDescending bool
+}
+
+// Arrow returns the indicator for the header of the column sorted by key.
+func (p indexPage) Arrow(key string) string {
+	switch {
+	case key != p.SortKey:
+		return ""
+	case p.SortDescending:
+		return "▼"
+	default:
+		return "▲"
+	}
+}
+
+func truncateText(text string, n int) (string, bool) {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text, false
+	}
+	return string(runes[:n]) + "…", true
+}
+
+func attachmentLabel(file Attachment) string {
+	var parts []string
+	if file.Format != "" {
+		parts = append(parts, strings.ToUpper(file.Format))
+	}
+	if file.Size > 0 {
+		parts = append(parts, formatSize(file.Size))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+func newCommentRow(commentWithAttachments CommentWithAttachments, loc *time.Location, root string) commentRow {
+	comment := commentWithAttachments.Comment
+	row := commentRow{
+		DocketID:     commentWithAttachments.DocketID,
+		ID:           comment.Data.ID,
+		URL:          commentURL(comment),
+		FirstName:    comment.Data.Attributes.FirstName,
+		LastName:     comment.Data.Attributes.LastName,
+		Email:        comment.Data.Attributes.Email,
+		InvalidEmail: comment.Data.Attributes.Email != "" && !commentWithAttachments.EmailValid,
+		Organization: comment.Data.Attributes.Organization,
+		Comment:      comment.Data.Attributes.Comment,
+
+		Location:      location(comment),
+		State:         strings.TrimSpace(comment.Data.Attributes.State),
+		SubmitterType: comment.Data.Attributes.SubmitterType,
+		GovAgency:     govAgency(comment),
+		APILink:       comment.Data.Links.Self,
+	}
+	row.CommentPreview, row.Truncated = truncateText(row.Comment, commentPreviewLength)
+	if !commentWithAttachments.PostedDate.IsZero() {
+		row.Posted = commentWithAttachments.PostedDate.In(loc).Format("2006-01-02 15:04 MST")
+		row.PostedSort = commentWithAttachments.PostedDate.UTC().Format(time.RFC3339)
+	}
+
+	files := make(map[string]Attachment)
+	for _, file := range commentWithAttachments.Files {
+		files[file.FileURL] = file
+	}
+	for _, attachment := range commentWithAttachments.Attachments {
+		link := attachmentLink{URL: attachment, Name: attachmentFilename(attachment)}
+		if localFile, ok := commentWithAttachments.LocalFiles[attachment]; ok {
+			link.URL = root + localFile
+		}
+		if file, ok := files[attachment]; ok {
+			link.Label = attachmentLabel(file)
+		}
+		link.TooLarge = slices.Contains(commentWithAttachments.TooLarge, attachment)
+		row.Attachments = append(row.Attachments, link)
+	}
+	return row
+}
+
+// location formats a commenter's address, e.g. "Boulder, CO 80301, United States".
+func location(comment Comment) string {
+	attributes := comment.Data.Attributes
+	region := strings.TrimSpace(attributes.State + " " + attributes.Zip)
+	var parts []string
+	for _, part := range []string{attributes.City, region, attributes.Country} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// govAgency describes the submitting government agency, e.g. "EPA (Federal)".
+func govAgency(comment Comment) string {
+	attributes := comment.Data.Attributes
+	switch {
+	case attributes.GovAgency == "":
+		return attributes.GovAgencyType
+	case attributes.GovAgencyType == "":
+		return attributes.GovAgency
+	}
+	return attributes.GovAgency + " (" + attributes.GovAgencyType + ")"
+}
+
+// countStates counts the rows from each state, in alphabetical order.
+func countStates(rows []commentRow) []stateCount {
+	counts := make(map[string]int)
+	for _, row := range rows {
+		if row.State != "" {
+			counts[row.State]++
+		}
+	}
+	states := make([]stateCount, 0, len(counts))
+	for state, n := range counts {
+		states = append(states, stateCount{State: state, Comments: n})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].State < states[j].State
+	})
+	return states
+}
+
+// pageTitle returns the title of the comments page for docketID, or of the
+// only page when docketID is empty.
+func pageTitle(cfg *Config, docketID string) string {
+	if cfg.PageTitle != "" {
+		if docketID != "" {
+			return cfg.PageTitle + " — " + docketID
+		}
+		return cfg.PageTitle
+	}
+	if docketID == "" && len(cfg.DocketIDs) == 1 && cfg.AgencyID == "" {
+		docketID = cfg.DocketIDs[0]
+	}
+	if docketID == "" {
+		return "Comments"
+	}
+	return "Comments on " + docketID
+}
+
+func newIndexPage(cfg *Config, comments []CommentWithAttachments, lastUpdated, docketID, root string, loc *time.Location) indexPage {
+	page := indexPage{
+		Title:       pageTitle(cfg, docketID),
+		Description: cfg.PageDescription,
+		LastUpdated: lastUpdated,
+		DocketID:    docketID,
+		Root:        root,
+		PageSize:    rowsPerPage,
+		Stats:       commentStats{DocketID: docketID},
+
+		ShowLocation:   cfg.ShowLocation,
+		ShowAPILinks:   cfg.ShowAPILinks,
+		SortKey:        cfg.SortKey,
+		SortDescending: cfg.SortDescending,
+	}
+	clusters := make(map[string]int)
+	for _, commentWithAttachments := range comments {
+		page.Stats.add(commentWithAttachments)
+		key := commentWithAttachments.ClusterKey
+		if cfg.ClusterDuplicates && key != "" {
+			if i, ok := clusters[key]; ok {
+				page.Comments[i].Duplicates++
+				continue
+			}
+			clusters[key] = len(page.Comments)
+		}
+		row := newCommentRow(commentWithAttachments, loc, root)
+		if cfg.LinkAttachedComments && len(row.Attachments) > 0 && refersToAttachment(row.Comment) {
+			row.FullCommentURL = row.Attachments[0].URL
+		}
+		page.ShowSubmitterType = page.ShowSubmitterType || row.SubmitterType != ""
+		page.ShowGovAgency = page.ShowGovAgency || row.GovAgency != ""
+		page.Comments = append(page.Comments, row)
+	}
+	if cfg.ShowLocation {
+		page.States = countStates(page.Comments)
+	}
+	return page
+}
+
+// emptyDockets returns the dockets whose last listing returned no documents.
+// Dockets that have not been listed yet are not included.
+func emptyDockets(cache *Cache, dockets []string) []string {
+	var empty []string
+	for _, docketID := range dockets {
+		if list, ok := cache.documentList(docketID); ok && len(list.IDs) == 0 {
+			empty = append(empty, docketID)
+		}
+	}
+	return empty
+}
+
+// sortKeys are the columns the HTML table can be ordered by.
+var sortKeys = []string{"posted", "lastname", "organization"}
+
+// sortComments orders comments by key. Ties are broken newest first and then
+// by API link, so the order is the same on every run.
+func sortComments(comments []CommentWithAttachments, key string, descending bool) {
+	sort.Slice(comments, func(i, j int) bool {
+		a, b := comments[i], comments[j]
+		var c int
+		switch key {
+		case "lastname":
+			c = strings.Compare(strings.ToLower(a.Comment.Data.Attributes.LastName), strings.ToLower(b.Comment.Data.Attributes.LastName))
+		case "organization":
+			c = strings.Compare(strings.ToLower(a.Comment.Data.Attributes.Organization), strings.ToLower(b.Comment.Data.Attributes.Organization))
+		default:
+			c = a.PostedDate.Compare(b.PostedDate)
+		}
+		if descending {
+			c = -c
+		}
+		if c == 0 {
+			c = b.PostedDate.Compare(a.PostedDate)
+		}
+		if c == 0 {
+			c = strings.Compare(a.Comment.Data.Links.Self, b.Comment.Data.Links.Self)
+		}
+		return c < 0
+	})
+}
+
+func writeIndexPage(path string, page indexPage) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return indexTemplate.Execute(w, page)
+	})
+}
+
+func generateHTML(cfg *Config, cache *Cache) error {
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return err
+	}
+
+	commentList := publishedComments(cfg, cache)
+
+	sortComments(commentList, cfg.SortKey, cfg.SortDescending)
+
+	lastUpdated := time.Now().In(loc).Format("2006-01-02 15:04:05 MST")
+
+	if len(cfg.DocketIDs) <= 1 && cfg.AgencyID == "" {
+		page := newIndexPage(cfg, commentList, lastUpdated, "", "", loc)
+		page.EmptyDockets = emptyDockets(cache, cfg.DocketIDs)
+		if err := writeIndexPage(filepath.Join(cfg.OutputDir, "index.html"), page); err != nil {
+			return err
+		}
+		slog.Info("HTML file generated")
+		return nil
+	}
+
+	byDocket := make(map[string][]CommentWithAttachments)
+	for _, docketID := range cfg.DocketIDs {
+		byDocket[docketID] = nil
+	}
+	for _, commentWithAttachments := range commentList {
+		byDocket[commentWithAttachments.DocketID] = append(byDocket[commentWithAttachments.DocketID], commentWithAttachments)
+	}
+
+	listing := docketsPage{Title: "Dockets", Description: cfg.PageDescription, LastUpdated: lastUpdated}
+	if cfg.PageTitle != "" {
+		listing.Title = cfg.PageTitle
+	}
+	for docketID, comments := range byDocket {
+		if !validDocketID(docketID) {
+			slog.Warn("skipping page for invalid docket ID", "docket", docketID)
+			continue
+		}
+		page := newIndexPage(cfg, comments, lastUpdated, docketID, "../", loc)
+		page.EmptyDockets = emptyDockets(cache, []string{docketID})
+		path := filepath.Join(cfg.OutputDir, docketID, "index.html")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := writeIndexPage(path, page); err != nil {
+			return fmt.Errorf("docket %s: %w", docketID, err)
+		}
+		listing.Stats.Comments += page.Stats.Comments
+		listing.Stats.WithAttachments += page.Stats.WithAttachments
+		listing.Stats.Attachments += page.Stats.Attachments
+		listing.Dockets = append(listing.Dockets, page.Stats)
+	}
+	sort.Slice(listing.Dockets, func(i, j int) bool {
+		return listing.Dockets[i].DocketID < listing.Dockets[j].DocketID
+	})
+
+	err = writeFileAtomic(filepath.Join(cfg.OutputDir, "index.html"), func(w io.Writer) error {
+		return docketsTemplate.Execute(w, listing)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("HTML file generated")
+	return nil
+}
+
+// ---------------------- organization view
+
+const individualOrganization = "Individual"
+
+const organizationsHTML = `<html>
+<head>
+	<title>Comments by Organization</title>
+    <style>
+    summary {
+      cursor: pointer;
+      padding: 4px 0;
+    }
+    </style>
+</head>
+<body>
+    <p><i>Data last updated: {{.LastUpdated}}</i></p>
+    <p><a href="index.html">All comments</a></p>
+    <p><b>{{len .Groups}}</b> organizations</p>
+    {{- range .Groups}}
+    <details>
+        <summary><b>{{.Name}}</b> ({{len .Comments}})</summary>
+        <ul>
+            {{- range .Comments}}
+            <li><a href="{{.URL}}">{{.ID}}</a>{{with .Posted}} — {{.}}{{end}}{{with .Author}} — {{.}}{{end}}</li>
+            {{- end}}
+        </ul>
+    </details>
+    {{- end}}
+</body>
+</html>
+`
+
+var organizationsTemplate = template.Must(template.New("organizations").Parse(organizationsHTML))
+
+type organizationComment struct {
+	ID     string
+	URL    string
+	Posted string
+	Author string
+}
+
+type organizationGroup struct {
+	Name     string
+	Comments []organizationComment
+}
+
+type organizationsPage struct {
+	LastUpdated string
+	Groups      []organizationGroup
+}
+
+func generateOrganizationsHTML(cfg *Config, cache *Cache) error {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return err
+	}
+
+	commentList := publishedComments(cfg, cache)
+	sort.Slice(commentList, func(i, j int) bool {
+		return commentList[i].PostedDate.After(commentList[j].PostedDate)
+	})
+
+	groups := make(map[string]*organizationGroup)
+	for _, comment := range commentList {
+		attributes := comment.Comment.Data.Attributes
+		name := strings.TrimSpace(attributes.Organization)
+		if name == "" {
+			name = individualOrganization
+		}
+		if groups[name] == nil {
+			groups[name] = &organizationGroup{Name: name}
+		}
+
+		entry := organizationComment{
+			ID:     comment.ID,
+			URL:    commentURL(comment.Comment),
+			Author: strings.TrimSpace(attributes.FirstName + " " + attributes.LastName),
+		}
+		if !comment.PostedDate.IsZero() {
+			entry.Posted = comment.PostedDate.In(loc).Format("2006-01-02")
+		}
+		groups[name].Comments = append(groups[name].Comments, entry)
+	}
+
+	page := organizationsPage{
+		LastUpdated: time.Now().In(loc).Format("2006-01-02 15:04:05 MST"),
+	}
+	for _, group := range groups {
+		page.Groups = append(page.Groups, *group)
+	}
+	sort.Slice(page.Groups, func(i, j int) bool {
+		if len(page.Groups[i].Comments) != len(page.Groups[j].Comments) {
+			return len(page.Groups[i].Comments) > len(page.Groups[j].Comments)
+		}
+		return page.Groups[i].Name < page.Groups[j].Name
+	})
+
+	err = writeFileAtomic(filepath.Join(cfg.OutputDir, "organizations.html"), func(w io.Writer) error {
+		return organizationsTemplate.Execute(w, page)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("organizations HTML file generated")
+	return nil
+}
+
+// ---------------------- CSV export
+
+const commentWebHost = "www.regulations.gov"
+
+// commentURL returns the public web page for a comment. The API's links point
+// at API resources, so a link is only used when it is on the public site;
+// otherwise the URL is built from the comment ID.
+func commentURL(comment Comment) string {
+	if u, err := url.Parse(comment.Data.Links.Self); err == nil && u.Host == commentWebHost {
+		return comment.Data.Links.Self
+	}
+	return fmt.Sprintf("https://%s/comment/%s", commentWebHost, comment.Data.ID)
+}
+
+func generateCSV(cfg *Config, cache *Cache, path string) error {
+	commentList := publishedComments(cfg, cache)
+	sort.Slice(commentList, func(i, j int) bool {
+		return commentList[i].Comment.Data.Links.Self < commentList[j].Comment.Data.Links.Self
+	})
+
+	err := writeFileAtomic(path, func(file io.Writer) error {
+		w := csv.NewWriter(file)
+		header := []string{"Comment ID", "Docket ID", "URL", "First Name", "Last Name", "Email", "Email Valid", "Raw Email", "Organization", "Submitter Type", "Government Agency", "Government Agency Type", "City", "State", "Country", "ZIP", "Comment", "Attachments"}
+		if cfg.ShowAPILinks {
+			header = append(header, "API Link")
+		}
+		w.Write(header)
+		for _, commentWithAttachments := range commentList {
+			attributes := commentWithAttachments.Comment.Data.Attributes
+			record := []string{
+				commentWithAttachments.ID,
+				commentWithAttachments.DocketID,
+				commentURL(commentWithAttachments.Comment),
+				attributes.FirstName,
+				attributes.LastName,
+				attributes.Email,
+				strconv.FormatBool(commentWithAttachments.EmailValid),
+				commentWithAttachments.RawEmail,
+				attributes.Organization,
+				attributes.SubmitterType,
+				attributes.GovAgency,
+				attributes.GovAgencyType,
+				attributes.City,
+				attributes.State,
+				attributes.Country,
+				attributes.Zip,
+				attributes.Comment,
+				strings.Join(commentWithAttachments.Attachments, ";"),
+			}
+			if cfg.ShowAPILinks {
+				record = append(record, commentWithAttachments.Comment.Data.Links.Self)
+			}
+			w.Write(record)
+		}
+		w.Flush()
+		return w.Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("CSV file generated", "path", path)
+	return nil
+}
+
+// ---------------------- JSON lines export
+
+// generateJSONL writes one compact JSON object per comment, in ID order, for
+// tools that stream newline-delimited JSON.
+func generateJSONL(cfg *Config, cache *Cache, path string) error {
+	commentList := publishedComments(cfg, cache)
+	sort.Slice(commentList, func(i, j int) bool {
+		return commentList[i].ID < commentList[j].ID
+	})
+
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		// Encode terminates each value with a newline.
+		encoder := json.NewEncoder(w)
+		for _, commentWithAttachments := range commentList {
+			if err := encoder.Encode(commentWithAttachments); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("JSON lines file generated", "path", path)
+	return nil
+}
+
+// ---------------------- precompressed outputs
+
+// compressibleExtensions are the generated output types that get a .gz copy
+// with -gzip.
+var compressibleExtensions = []string{".html", ".csv", ".jsonl"}
+
+// compressOutputs writes a gzip copy next to every generated output in dir.
+// Mirrored attachments are left alone.
+func compressOutputs(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path == filepath.Join(dir, attachmentsDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !slices.Contains(compressibleExtensions, filepath.Ext(path)) {
+			return nil
+		}
+		return gzipFile(path)
+	})
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeFileAtomic(path+".gz", func(w io.Writer) error {
+		gz, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(gz, src); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+}
+
+// precompressedHandler serves the .gz copy of a generated output to clients
+// that accept gzip, and otherwise falls through to next. A copy older than
+// its original is ignored, so stale files left from an earlier -gzip run are
+// never served.
+func precompressedHandler(dir string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = path.Join(name, "index.html")
+		}
+		ext := path.Ext(name)
+		if !slices.Contains(compressibleExtensions, ext) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		original, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)) + ".gz")
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		compressed, err := f.Stat()
+		if err != nil || compressed.ModTime().Before(original.ModTime()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		contentType := mime.TypeByExtension(ext)
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, name, compressed.ModTime(), f)
+	})
+}
+
+// ---------------------- HTTP server
+
+// compressibleType reports whether responses of a content type benefit from
+// gzip. Images, PDFs, and archives are already compressed.
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml",
+		"application/rss+xml", "application/jsonl", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// gzipResponseWriter compresses the body once the response headers show that
+// it is worth compressing and has not been encoded already.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	started bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.started {
+		return
+	}
+	w.started = true
+	header := w.Header()
+	if code == http.StatusOK && header.Get("Content-Encoding") == "" && compressibleType(header.Get("Content-Type")) {
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		header.Set("Content-Encoding", "gzip")
+		if !slices.Contains(header.Values("Vary"), "Accept-Encoding") {
+			header.Add("Vary", "Accept-Encoding")
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// gzipHandler compresses responses from next for clients that accept gzip.
+// HEAD and range requests are passed through untouched.
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" ||
+			!strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+		if err := gw.close(); err != nil {
+			slog.Debug("error finishing gzip response", "path", r.URL.Path, "error", err)
+		}
+	})
+}
+
+func commentsHandler(cfg *Config, cache *Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		comments := publishedComments(cfg, cache)
+		if v := r.URL.Query().Get("with_attachments"); v != "" {
+			only, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "with_attachments must be true or false", http.StatusBadRequest)
+				return
+			}
+			if only {
+				comments = withAttachments(comments)
+			}
+		}
+		if comments == nil {
+			comments = []CommentWithAttachments{}
+		}
+		sort.Slice(comments, func(i, j int) bool {
+			return comments[i].ID < comments[j].ID
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(comments); err != nil {
+			slog.Error("error encoding comments", "error", err)
+		}
+	}
+}
+
+func searchHandler(cfg *Config, cache *Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+		if strings.TrimSpace(query) == "" {
+			http.Error(w, "q is required", http.StatusBadRequest)
+			return
+		}
+
+		comments := publishable(cfg, cache.search(query))
+		if comments == nil {
+			comments = []CommentWithAttachments{}
+		}
+		sort.Slice(comments, func(i, j int) bool {
+			return comments[i].ID < comments[j].ID
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(comments); err != nil {
+			slog.Error("error encoding search results", "error", err)
+		}
+	}
+}
+
+const feedSize = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Link    atomLink   `xml:"link"`
+	Author  atomAuthor `xml:"author"`
+	Summary string     `xml:"summary,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+func commentAuthor(comment Comment) string {
+	attributes := comment.Data.Attributes
+	name := strings.TrimSpace(attributes.FirstName + " " + attributes.LastName)
+	switch {
+	case name != "" && attributes.Organization != "":
+		return name + " (" + attributes.Organization + ")"
+	case name != "":
+		return name
+	case attributes.Organization != "":
+		return attributes.Organization
+	}
+	return "Anonymous"
+}
+
+func feedTitle(cfg *Config) string {
+	subjects := append([]string{}, cfg.DocketIDs...)
+	if cfg.AgencyID != "" {
+		subjects = append(subjects, cfg.AgencyID+" dockets")
+	}
+	return "Comments on " + strings.Join(subjects, ", ")
+}
+
+func feedHandler(cfg *Config, cache *Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		comments := publishedComments(cfg, cache)
+		sort.Slice(comments, func(i, j int) bool {
+			return comments[i].PostedDate.After(comments[j].PostedDate)
+		})
+		if len(comments) > feedSize {
+			comments = comments[:feedSize]
+		}
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		self := scheme + "://" + r.Host + r.URL.Path
+
+		feed := atomFeed{
+			Title:   feedTitle(cfg),
+			ID:      self,
+			Updated: time.Now().UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: self, Rel: "self"},
+		}
+		if len(comments) > 0 && !comments[0].PostedDate.IsZero() {
+			feed.Updated = comments[0].PostedDate.UTC().Format(time.RFC3339)
+		}
+		for _, comment := range comments {
+			link := commentURL(comment.Comment)
+			summary, _ := truncateText(comment.Comment.Data.Attributes.Comment, commentPreviewLength)
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:   "Comment " + comment.ID,
+				ID:      link,
+				Updated: comment.PostedDate.UTC().Format(time.RFC3339),
+				Link:    atomLink{Href: link},
+				Author:  atomAuthor{Name: commentAuthor(comment.Comment)},
+				Summary: summary,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		if err := xml.NewEncoder(w).Encode(feed); err != nil {
+			slog.Error("error encoding feed", "error", err)
+		}
+	}
+}
+
+type healthStatus struct {
+	Comments             int             `json:"comments"`
+	LastSuccessfulUpdate *time.Time      `json:"lastSuccessfulUpdate"`
+	Quota                *QuotaStatus    `json:"quota,omitempty"`
+	Progress             *ProgressStatus `json:"progress,omitempty"`
+}
+
+func healthHandler(cache *Cache, client *APIClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var status healthStatus
+		var lastUpdate time.Time
+		status.Comments, lastUpdate = cache.stats()
+		if !lastUpdate.IsZero() {
+			status.LastSuccessfulUpdate = &lastUpdate
+		}
+		if quota, ok := client.quotaStatus(); ok {
+			status.Quota = &quota
+		}
+		if current, ok := cache.progress.snapshot(); ok {
+			status.Progress = &current
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			slog.Error("error encoding health status", "error", err)
+		}
+	}
+}
+
+type refreshResult struct {
+	NewComments int      `json:"newComments"`
+	CommentIDs  []string `json:"commentIds"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// refreshHandler runs an update on POST with the refresh token as a bearer
+// token, and responds with the comments it added. Refreshes closer together
+// than refreshDebounce, or while another update is running, are refused. The
+// update runs under ctx rather than the request's context, so a client
+// disconnecting does not abort it.
+func refreshHandler(ctx context.Context, updates *updater, token string, behindProxy bool) http.HandlerFunc {
+	wantToken := sha256.Sum256([]byte(token))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		gotToken := sha256.Sum256([]byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")))
+		if subtle.ConstantTimeCompare(gotToken[:], wantToken[:]) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		client := r.RemoteAddr
+		if addr, err := clientAddr(r, behindProxy); err == nil {
+			client = addr.String()
+		}
+		slog.Info("manual refresh requested", "client", client)
+		added, wait, err := updates.refresh(ctx, time.Now())
+		if errors.Is(err, errUpdateInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "refreshed too recently", http.StatusTooManyRequests)
+			return
+		}
+		result := refreshResult{NewComments: len(added), CommentIDs: added}
+		status := http.StatusOK
+		if err != nil {
+			result.Error = err.Error()
+			status = http.StatusBadGateway
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("error encoding refresh result", "error", err)
+		}
+	}
+}
+
+// recentHandler serves the IDs of the comments added by the last update.
+func recentHandler(cache *Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cache.recentlyAdded()); err != nil {
+			slog.Error("error encoding recent comments", "error", err)
+		}
+	}
+}
+
+func metricsHandler(cache *Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		comments, lastUpdate := cache.stats()
+		var lastUpdateSeconds float64
+		if !lastUpdate.IsZero() {
+			lastUpdateSeconds = float64(lastUpdate.Unix())
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetric(w, "fdms_api_requests_total", "counter", "Requests sent to the regulations.gov API.", float64(metrics.apiRequests.Load()))
+		writeMetric(w, "fdms_api_request_failures_total", "counter", "API requests that failed or returned a non-2xx status.", float64(metrics.apiFailures.Load()))
+		writeMetric(w, "fdms_comments_fetched_total", "counter", "Comments fetched from the API.", float64(metrics.commentsFetched.Load()))
+		writeMetric(w, "fdms_attachments_downloaded_total", "counter", "Attachments downloaded into the output directory.", float64(metrics.attachmentsDownloaded.Load()))
+		writeMetric(w, "fdms_updates_total", "counter", "Cache update runs started.", float64(metrics.updates.Load()))
+		writeMetric(w, "fdms_update_failures_total", "counter", "Cache update runs that failed.", float64(metrics.updateFailures.Load()))
+		writeMetric(w, "fdms_cached_comments", "gauge", "Comments currently in the cache.", float64(comments))
+		writeMetric(w, "fdms_last_successful_update_timestamp_seconds", "gauge", "Unix time of the last successful update, or 0 if none.", lastUpdateSeconds)
+	}
+}
+
+// basicAuth requires the configured credentials on every request except
+// /healthz, which stays open for uptime checks, and /refresh, which carries
+// its own token in the same Authorization header.
+func basicAuth(user, password string, next http.Handler) http.Handler {
+	wantUser := sha256.Sum256([]byte(user))
+	wantPassword := sha256.Sum256([]byte(password))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/refresh" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gotUser, gotPassword, ok := r.BasicAuth()
+		// Hashing first keeps the comparisons constant-time regardless of
+		// the lengths involved.
+		userHash := sha256.Sum256([]byte(gotUser))
+		passwordHash := sha256.Sum256([]byte(gotPassword))
+		userOK := subtle.ConstantTimeCompare(userHash[:], wantUser[:]) == 1
+		passwordOK := subtle.ConstantTimeCompare(passwordHash[:], wantPassword[:]) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="FDMS", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientAddr returns the address of the client that sent r. Behind a trusted
+// reverse proxy that is the last X-Forwarded-For entry, the one appended by
+// the proxy itself; earlier entries are supplied by the client and not
+// trusted.
+func clientAddr(r *http.Request, behindProxy bool) (netip.Addr, error) {
+	if behindProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			return netip.ParseAddr(strings.TrimSpace(hops[len(hops)-1]))
+		}
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addrPort.Addr(), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// ipFilter rejects clients in deny, and clients outside allow when allow is
+// not empty, with 403 Forbidden.
+func ipFilter(allow, deny []netip.Prefix, behindProxy bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := clientAddr(r, behindProxy)
+		if err != nil {
+			slog.Warn("rejecting request with unparseable client address", "remoteAddr", r.RemoteAddr, "error", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		addr = addr.Unmap()
+		if containsAddr(deny, addr) || (len(allow) > 0 && !containsAddr(allow, addr)) {
+			slog.Debug("rejecting request from disallowed address", "client", addr, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs. A bare address is
+// taken as a single-host prefix.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range splitList(s) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func newMux(ctx context.Context, cfg *Config, cache *Cache, client *APIClient, updates *updater) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", gzipHandler(precompressedHandler(cfg.OutputDir, http.FileServer(http.Dir(cfg.OutputDir)))))
+	mux.Handle("/api/comments", commentsHandler(cfg, cache))
+	mux.Handle("/search", searchHandler(cfg, cache))
+	mux.Handle("/healthz", healthHandler(cache, client))
+	mux.Handle("/recent", recentHandler(cache))
+	mux.Handle("/feed.xml", feedHandler(cfg, cache))
+	mux.Handle("/metrics", metricsHandler(cache))
+	if updates != nil && cfg.RefreshToken != "" {
+		mux.Handle("/refresh", refreshHandler(ctx, updates, cfg.RefreshToken, cfg.BehindProxy))
+	}
+	var handler http.Handler = mux
+	if cfg.BasicAuthUser != "" {
+		handler = basicAuth(cfg.BasicAuthUser, cfg.BasicAuthPassword, handler)
+	}
+	if len(cfg.AllowCIDRs) > 0 || len(cfg.DenyCIDRs) > 0 {
+		handler = ipFilter(cfg.AllowCIDRs, cfg.DenyCIDRs, cfg.BehindProxy, handler)
+	}
+	return handler
+}
+
+// redirectToHTTPS redirects plain HTTP requests to the HTTPS port. Behind a
+// trusted reverse proxy, requests the proxy received over HTTPS (per
+// X-Forwarded-Proto) are passed to next instead, which avoids redirect loops
+// when the proxy terminates TLS, and redirects go to X-Forwarded-Host.
+func redirectToHTTPS(httpsPort string, behindProxy bool, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if behindProxy && r.Header.Get("X-Forwarded-Proto") == "https" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); behindProxy && forwardedHost != "" {
+			host = forwardedHost
+		}
+		if addr, err := clientAddr(r, behindProxy); err == nil {
+			slog.Debug("redirecting to HTTPS", "client", addr, "host", host, "path", r.URL.Path)
+		}
+		http.Redirect(w, r, "https://"+host+r.RequestURI, http.StatusMovedPermanently)
+	}
+}
+
+// runServer calls listen and blocks until it fails or ctx is canceled, in
+// which case the server is shut down and in-flight requests are drained.
+func runServer(ctx context.Context, server *http.Server, listen func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- listen()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down server", "addr", server.Addr)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	slog.Info("server shut down cleanly", "addr", server.Addr)
+	return nil
+}
+
+func certFiles(certPath string) (string, string) {
+	return filepath.Join(certPath, "fullchain.pem"), filepath.Join(certPath, "privkey.pem")
+}
+
+func certsAvailable(certPath string) bool {
+	if certPath == "" {
+		return false
+	}
+	certFile, keyFile := certFiles(certPath)
+	for _, path := range []string{certFile, keyFile} {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCertificate loads the certificate and key the HTTPS server will use, so
+// that unreadable, mismatched, or expired files are reported before binding.
+func checkCertificate(certFile, keyFile string, now time.Time) error {
+	for _, path := range []string{certFile, keyFile} {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("loading key pair %s, %s: %w", certFile, keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing certificate %s: %w", certFile, err)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate %s expired on %s", certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate %s is not valid until %s", certFile, leaf.NotBefore.Format(time.RFC3339))
+	}
+	if leaf.NotAfter.Sub(now) < certExpiryWarning {
+		slog.Warn("TLS certificate expires soon", "path", certFile, "notAfter", leaf.NotAfter)
+	}
+	return nil
+}
+
+func startServerHTTPS(ctx context.Context, cfg *Config, handler http.Handler) {
+	certFile, keyFile := certFiles(cfg.CertPath)
+	if err := checkCertificate(certFile, keyFile, time.Now()); err != nil {
+		fatal("invalid TLS certificate", "error", err)
+	}
+
+	slog.Info("starting HTTPS server", "port", cfg.HTTPSPort)
+	server := &http.Server{Addr: ":" + cfg.HTTPSPort, Handler: handler}
+	serveTLS(ctx, server, cfg.RedirectPort, redirectToHTTPS(cfg.HTTPSPort, cfg.BehindProxy, handler), certFile, keyFile)
+}
+
+// startServerAutocert serves HTTPS with certificates obtained and renewed
+// from Let's Encrypt for AutocertDomains, cached in AutocertDir. The redirect
+// server also answers the ACME HTTP-01 challenges, so RedirectPort must be
+// reachable on 80.
+func startServerAutocert(ctx context.Context, cfg *Config, handler http.Handler) {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+		Cache:      autocert.DirCache(cfg.AutocertDir),
+	}
+
+	slog.Info("starting HTTPS server with automatic certificates", "port", cfg.HTTPSPort, "domains", cfg.AutocertDomains, "cacheDir", cfg.AutocertDir)
+	server := &http.Server{Addr: ":" + cfg.HTTPSPort, Handler: handler, TLSConfig: manager.TLSConfig()}
+	serveTLS(ctx, server, cfg.RedirectPort, manager.HTTPHandler(redirectToHTTPS(cfg.HTTPSPort, cfg.BehindProxy, handler)), "", "")
+}
+
+// serveTLS runs server over TLS alongside a plain HTTP server on redirectPort
+// using redirect, until ctx is cancelled.
+func serveTLS(ctx context.Context, server *http.Server, redirectPort string, redirect http.Handler, certFile, keyFile string) {
+	redirectServer := &http.Server{Addr: ":" + redirectPort, Handler: redirect}
+	go func() {
+		slog.Info("redirecting HTTP to HTTPS", "port", redirectPort)
+		if err := runServer(ctx, redirectServer, redirectServer.ListenAndServe); err != nil {
+			fatal("ListenAndServe failed", "error", err)
+		}
+	}()
+
+	err := runServer(ctx, server, func() error {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	})
+	if err != nil {
+		fatal("ListenAndServeTLS failed", "error", err)
+	}
+}
+
+func startServer(ctx context.Context, cfg *Config, handler http.Handler) {
+	slog.Info("starting server", "port", cfg.HTTPPort)
+	server := &http.Server{Addr: ":" + cfg.HTTPPort, Handler: handler}
+	if err := runServer(ctx, server, server.ListenAndServe); err != nil {
+		fatal("ListenAndServe failed", "error", err)
+	}
+}
+
+// ---------------------- webhook
+
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type webhookPayload struct {
+	// Text makes the payload render as a message in Slack-compatible hooks.
+	Text       string   `json:"text"`
+	NewCount   int      `json:"newComments"`
+	CommentIDs []string `json:"commentIds"`
+}
+
+// notifyWebhook POSTs a summary of the comments added in an update cycle,
+// retrying failed deliveries with backoff.
+func notifyWebhook(ctx context.Context, webhookURL string, added []string) error {
+	payload := webhookPayload{
+		Text:       fmt.Sprintf("%d new comments: %s", len(added), strings.Join(added, ", ")),
+		NewCount:   len(added),
+		CommentIDs: added,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, backoffDelay(attempt-1)); err != nil {
+				return err
+			}
+		}
+		lastErr = postWebhook(ctx, webhookURL, body)
+		if lastErr == nil {
+			slog.Info("webhook notified", "newComments", len(added))
+			return nil
+		}
+		slog.Warn("webhook delivery failed", "attempt", attempt+1, "error", lastErr)
+	}
+	return lastErr
+}
+
+func postWebhook(ctx context.Context, webhookURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, bodySnippetLength*4))
+		return &StatusError{URL: webhookURL, StatusCode: resp.StatusCode, Body: bodySnippet(snippet)}
+	}
+	return nil
+}
+
+// ---------------------- configuration
+
+// Config holds the settings read from flags and the environment at startup.
+type Config struct {
+	APIKeys     []string
+	APIBaseURL  string
+	CertPath    string
+	OutputDir   string
+	CachePath   string
+	AgencyID    string
+	DocketIDs   []string
+	HTTPTimeout time.Duration
+	ProxyURL    *url.URL
+	UserAgent   string
+	// WebhookURL, if set, receives a POST after each update that added comments.
+	WebhookURL string
+
+	// Mode is serve, update, or both.
+	Mode      string
+	Once      bool
+	DryRun    bool
+	Resume    bool
+	ForceHTTP bool
+
+	Autocert        bool
+	AutocertDomains []string
+	AutocertDir     string
+
+	Mirror              bool
+	OnlyWithAttachments bool
+	RedactEmails        bool
+	ClusterDuplicates   bool
+	// Precompress writes a gzip copy of each generated output for the file
+	// server to send to clients that accept it.
+	Precompress bool
+	// PageTitle and PageDescription brand the generated HTML pages. The title
+	// defaults to naming the docket.
+	PageTitle       string
+	PageDescription string
+	// ShowLocation adds a commenter location column and state filter to the
+	// HTML table.
+	ShowLocation bool
+	// ShowAPILinks adds each comment's API self link to the HTML table and
+	// the CSV file, for scripting against the API.
+	ShowAPILinks bool
+	// LinkAttachedComments links the first attachment as the full text of
+	// comments that only point to an attached file.
+	LinkAttachedComments bool
+	// MaxAttachmentBytes caps the size of mirrored attachments; 0 means no limit.
+	MaxAttachmentBytes int64
+
+	FetchConcurrency int
+	// MirrorConcurrency is how many comments have attachments mirrored at once.
+	MirrorConcurrency int
+	RequestsPerHour   int
+	MaxAttempts       int
+	RefreshInterval   time.Duration
+	// UpdateTimeout bounds each update cycle; 0 means no limit. HTTPTimeout
+	// bounds each request within it.
+	UpdateTimeout time.Duration
+
+	// PostedStart and PostedEnd restrict comment listings to an inclusive
+	// range of posted dates (YYYY-MM-DD). Either may be empty to leave that
+	// side open.
+	PostedStart string
+	PostedEnd   string
+
+	// SortKey is one of sortKeys and orders the rows of the HTML table.
+	SortKey        string
+	SortDescending bool
+
+	HTTPSPort    string
+	RedirectPort string
+	HTTPPort     string
+
+	// BasicAuthUser and BasicAuthPassword, when set, protect the served site
+	// with HTTP Basic Auth.
+	BasicAuthUser     string
+	BasicAuthPassword string
+	// RefreshToken enables POST /refresh for clients that send it as a
+	// bearer token.
+	RefreshToken string
+	// AllowCIDRs, if not empty, lists the only client networks that are
+	// served; DenyCIDRs lists networks that are always refused.
+	AllowCIDRs []netip.Prefix
+	DenyCIDRs  []netip.Prefix
+	// BehindProxy trusts the X-Forwarded-* headers set by a reverse proxy for
+	// the client address and the scheme and host of the original request.
+	BehindProxy bool
+}
+
+// updating reports whether this process fetches from the API, as opposed to
+// only serving what another process writes.
+func (cfg *Config) updating() bool {
+	return cfg.Mode != "serve" || cfg.Once || cfg.DryRun
+}
+
+// positiveInt parses the value of a setting that must be a positive integer.
+func positiveInt(name, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive integer", name, value)
+	}
+	return n, nil
+}
+
+// defaultConfig returns the settings used when neither a flag nor an
+// environment variable overrides them.
+func defaultConfig() *Config {
+	return &Config{
+		APIBaseURL:        defaultAPIBaseURL,
+		OutputDir:         defaultOutputDir,
+		CachePath:         defaultCachePath,
+		HTTPTimeout:       defaultHTTPTimeout,
+		SortKey:           "posted",
+		SortDescending:    true,
+		UserAgent:         defaultUserAgent,
+		AutocertDir:       defaultAutocertDir,
+		FetchConcurrency:  defaultFetchConcurrency,
+		MirrorConcurrency: defaultMirrorConcurrency,
+		RequestsPerHour:   defaultRequestsPerHour,
+		MaxAttempts:       defaultMaxAttempts,
+		RefreshInterval:   defaultRefreshInterval,
+		HTTPSPort:         "443",
+		RedirectPort:      "80",
+		HTTPPort:          "8080",
+	}
+}
+
+// loadConfig parses the command line and reads the environment, with flags
+// taking precedence over the environment variables they override.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	docketFlag := flag.String("docket", "", "comma-separated list of docket IDs to monitor (overrides DOCKET_IDS)")
+	outputDirFlag := flag.String("output-dir", "", "directory for generated files, also served over HTTP (overrides OUTPUT_DIR, default static)")
+	agencyFlag := flag.String("agency", "", "also archive every docket of this agency, e.g. NIST (overrides AGENCY_ID)")
+	flag.BoolVar(&cfg.Mirror, "mirror", false, "download attachments into the output directory and link to the local copies")
+	refreshFlag := flag.String("refresh", "", "time between cache updates, e.g. 10m (overrides REFRESH_INTERVAL)")
+	updateTimeoutFlag := flag.String("update-timeout", "", "stop an update cycle after this long and keep what it fetched, e.g. 2h (overrides UPDATE_TIMEOUT, default no limit)")
+	httpsPortFlag := flag.String("https-port", "", "HTTPS listen port (overrides HTTPS_PORT, default 443)")
+	redirectPortFlag := flag.String("redirect-port", "", "HTTP-to-HTTPS redirect listen port (overrides REDIRECT_PORT, default 80)")
+	httpPortFlag := flag.String("http-port", "", "plain HTTP listen port (overrides HTTP_PORT, default 8080)")
+	concurrencyFlag := flag.String("concurrency", "", "number of comments fetched in parallel (overrides FETCH_CONCURRENCY, default 4)")
+	mirrorConcurrencyFlag := flag.String("mirror-concurrency", "", "number of comments whose attachments are mirrored in parallel (overrides MIRROR_CONCURRENCY, default 2)")
+	startFlag := flag.String("start-date", "", "only fetch comments posted on or after this date, YYYY-MM-DD (overrides POSTED_START)")
+	endFlag := flag.String("end-date", "", "only fetch comments posted on or before this date, YYYY-MM-DD (overrides POSTED_END)")
+	titleFlag := flag.String("title", "", "title of the generated HTML pages (overrides PAGE_TITLE, default names the docket)")
+	descriptionFlag := flag.String("description", "", "text shown under the title of the generated HTML pages (overrides PAGE_DESCRIPTION)")
+	sortFlag := flag.String("sort", "", "HTML table order: posted, lastname, or organization, optionally followed by :asc or :desc (overrides SORT_ORDER, default posted:desc)")
+	flag.BoolVar(&cfg.OnlyWithAttachments, "with-attachments", false, "only include comments that have attachments in the HTML, CSV, and JSON outputs")
+	flag.BoolVar(&cfg.RedactEmails, "redact-email", false, "mask commenter email addresses in the HTML, CSV, and JSON outputs")
+	flag.BoolVar(&cfg.ShowLocation, "location", false, "show commenter locations in the HTML table, with a filter by state")
+	flag.BoolVar(&cfg.ShowAPILinks, "api-links", false, "add each comment's regulations.gov API link to the HTML table and CSV file")
+	flag.BoolVar(&cfg.Precompress, "gzip", false, "also write gzip-compressed copies of the HTML, CSV, and JSON lines outputs and serve them to clients that accept gzip")
+	flag.BoolVar(&cfg.ClusterDuplicates, "cluster", false, "collapse comments with identical normalized text into one HTML row with a count")
+	flag.BoolVar(&cfg.LinkAttachedComments, "see-attached", false, `link the attachment as the full comment when the text is just "see attached"`)
+	flag.StringVar(&cfg.Mode, "mode", "both", "what to run: serve (static files only), update (fetch loop only), or both")
+	flag.BoolVar(&cfg.Resume, "resume", false, "checkpoint update progress and continue interrupted updates on restart")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "list documents and comment IDs, report what an update would fetch, and exit")
+	flag.BoolVar(&cfg.Once, "once", false, "run a single update, write the outputs, and exit without serving")
+	flag.BoolVar(&cfg.BehindProxy, "behind-proxy", false, "trust X-Forwarded-For and X-Forwarded-Proto from a reverse proxy for client addresses and HTTPS redirects")
+	flag.BoolVar(&cfg.ForceHTTP, "force-http", false, "serve plain HTTP even when certificates are available")
+	flag.BoolVar(&cfg.Autocert, "autocert", false, "obtain and renew certificates from Let's Encrypt instead of reading CERT_PATH")
+	domainFlag := flag.String("domain", "", "comma-separated domains to request certificates for with -autocert (overrides AUTOCERT_DOMAINS)")
+	webhookFlag := flag.String("webhook", "", "URL to POST a JSON summary to after updates that add comments (overrides WEBHOOK_URL)")
+	proxyFlag := flag.String("proxy", "", "proxy URL for outbound requests (overrides PROXY_URL, default from HTTP_PROXY/HTTPS_PROXY)")
+	flag.Parse()
+
+	switch cfg.Mode {
+	case "serve", "update", "both":
+	default:
+		return nil, fmt.Errorf("invalid -mode %q: expected serve, update, or both", cfg.Mode)
+	}
+
+	apiKey := os.Getenv("API_KEY")
+	if path := os.Getenv("API_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading API_KEY_FILE: %w", err)
+		}
+		apiKey = strings.TrimSpace(string(data))
+	}
+	cfg.APIKeys = splitList(os.Getenv("API_KEYS"))
+	if len(cfg.APIKeys) == 0 && apiKey != "" {
+		cfg.APIKeys = []string{apiKey}
+	}
+	if cfg.updating() && len(cfg.APIKeys) == 0 {
+		return nil, errors.New("API_KEY, API_KEY_FILE, or API_KEYS environment variable is required")
+	}
+	cfg.CertPath = os.Getenv("CERT_PATH")
+
+	if cfg.Autocert {
+		if cfg.ForceHTTP {
+			return nil, errors.New("-autocert and -force-http cannot be used together")
+		}
+		cfg.AutocertDomains = splitList(configValue(*domainFlag, "AUTOCERT_DOMAINS"))
+		if len(cfg.AutocertDomains) == 0 {
+			return nil, errors.New("-autocert requires -domain or AUTOCERT_DOMAINS")
+		}
+		if v := os.Getenv("AUTOCERT_CACHE_DIR"); v != "" {
+			cfg.AutocertDir = v
+		}
+	}
+
+	if v := os.Getenv("API_BASE_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid API_BASE_URL %q: expected an absolute URL", v)
+		}
+		cfg.APIBaseURL = strings.TrimRight(v, "/")
+	}
+
+	if v := configValue(*outputDirFlag, "OUTPUT_DIR"); v != "" {
+		cfg.OutputDir = v
+	}
+	if v := os.Getenv("CACHE_PATH"); v != "" {
+		cfg.CachePath = v
+	}
+
+	cfg.AgencyID = strings.ToUpper(configValue(*agencyFlag, "AGENCY_ID"))
+	if cfg.AgencyID != "" && !agencyIDPattern.MatchString(cfg.AgencyID) {
+		return nil, fmt.Errorf("invalid agency ID %q: expected letters only, e.g. NIST", cfg.AgencyID)
+	}
+
+	cfg.DocketIDs = splitList(configValue(*docketFlag, "DOCKET_IDS"))
+	if len(cfg.DocketIDs) == 0 && cfg.AgencyID == "" {
+		cfg.DocketIDs = []string{defaultDocketID}
+	}
+	for i, docketID := range cfg.DocketIDs {
+		cfg.DocketIDs[i] = strings.ToUpper(docketID)
+		if !validDocketID(cfg.DocketIDs[i]) {
+			return nil, fmt.Errorf("invalid docket ID %q: expected AGENCY-YEAR-NUMBER, e.g. %s", docketID, defaultDocketID)
+		}
+	}
+
+	if v := os.Getenv("HTTP_TIMEOUT_SECONDS"); v != "" {
+		seconds, err := positiveInt("HTTP_TIMEOUT_SECONDS", v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.HTTPTimeout = time.Duration(seconds) * time.Second
+	}
+
+	if v := configValue(*proxyFlag, "PROXY_URL"); v != "" {
+		proxyURL, err := url.Parse(v)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, errors.New("invalid PROXY_URL: must be an absolute URL")
+		}
+		cfg.ProxyURL = proxyURL
+	}
+
+	if v := configValue(*webhookFlag, "WEBHOOK_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("invalid WEBHOOK_URL: must be an absolute http or https URL")
+		}
+		cfg.WebhookURL = v
+	}
+
+	if v := os.Getenv("MAX_ATTACHMENT_BYTES"); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid MAX_ATTACHMENT_BYTES %q: must be a non-negative integer", v)
+		}
+		cfg.MaxAttachmentBytes = limit
+	}
+
+	if v := os.Getenv("USER_AGENT"); v != "" {
+		cfg.UserAgent = v
+	}
+
+	cfg.RefreshToken = os.Getenv("REFRESH_TOKEN")
+
+	cfg.BasicAuthUser = os.Getenv("BASIC_AUTH_USER")
+	cfg.BasicAuthPassword = os.Getenv("BASIC_AUTH_PASSWORD")
+	if (cfg.BasicAuthUser == "") != (cfg.BasicAuthPassword == "") {
+		return nil, errors.New("BASIC_AUTH_USER and BASIC_AUTH_PASSWORD must be set together")
+	}
+
+	for _, setting := range []struct {
+		envKey string
+		target *[]netip.Prefix
+	}{
+		{"ALLOW_CIDRS", &cfg.AllowCIDRs},
+		{"DENY_CIDRS", &cfg.DenyCIDRs},
+	} {
+		prefixes, err := parsePrefixes(os.Getenv(setting.envKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", setting.envKey, err)
+		}
+		*setting.target = prefixes
+	}
+
+	for _, setting := range []struct {
+		flagValue, envKey string
+		target            *int
+	}{
+		{*concurrencyFlag, "FETCH_CONCURRENCY", &cfg.FetchConcurrency},
+		{*mirrorConcurrencyFlag, "MIRROR_CONCURRENCY", &cfg.MirrorConcurrency},
+		{"", "REQUESTS_PER_HOUR", &cfg.RequestsPerHour},
+		{"", "MAX_ATTEMPTS", &cfg.MaxAttempts},
+	} {
+		if v := configValue(setting.flagValue, setting.envKey); v != "" {
+			n, err := positiveInt(setting.envKey, v)
+			if err != nil {
+				return nil, err
+			}
+			*setting.target = n
+		}
+	}
+
+	for _, port := range []struct {
+		flagValue, envKey string
+		target            *string
+	}{
+		{*httpsPortFlag, "HTTPS_PORT", &cfg.HTTPSPort},
+		{*redirectPortFlag, "REDIRECT_PORT", &cfg.RedirectPort},
+		{*httpPortFlag, "HTTP_PORT", &cfg.HTTPPort},
+	} {
+		if v := configValue(port.flagValue, port.envKey); v != "" {
+			parsed, err := parsePort(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", port.envKey, err)
+			}
+			*port.target = parsed
+		}
+	}
+
+	cfg.PageTitle = configValue(*titleFlag, "PAGE_TITLE")
+	cfg.PageDescription = configValue(*descriptionFlag, "PAGE_DESCRIPTION")
+
+	if v := configValue(*sortFlag, "SORT_ORDER"); v != "" {
+		key, order, _ := strings.Cut(v, ":")
+		if !slices.Contains(sortKeys, key) {
+			return nil, fmt.Errorf("invalid sort key %q: must be one of %s", key, strings.Join(sortKeys, ", "))
+		}
+		cfg.SortKey = key
+		switch order {
+		case "":
+			cfg.SortDescending = key == "posted"
+		case "asc", "desc":
+			cfg.SortDescending = order == "desc"
+		default:
+			return nil, fmt.Errorf("invalid sort order %q: must be asc or desc", order)
+		}
+	}
+
+	cfg.PostedStart = configValue(*startFlag, "POSTED_START")
+	cfg.PostedEnd = configValue(*endFlag, "POSTED_END")
+	var start, end time.Time
+	var err error
+	if cfg.PostedStart != "" {
+		if start, err = time.Parse(postedDateLayout, cfg.PostedStart); err != nil {
+			return nil, fmt.Errorf("invalid start date %q: expected YYYY-MM-DD", cfg.PostedStart)
+		}
+	}
+	if cfg.PostedEnd != "" {
+		if end, err = time.Parse(postedDateLayout, cfg.PostedEnd); err != nil {
+			return nil, fmt.Errorf("invalid end date %q: expected YYYY-MM-DD", cfg.PostedEnd)
+		}
+	}
+	if cfg.PostedStart != "" && cfg.PostedEnd != "" && end.Before(start) {
+		return nil, fmt.Errorf("end date %s is before start date %s", cfg.PostedEnd, cfg.PostedStart)
+	}
+
+	if v := configValue(*refreshFlag, "REFRESH_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid refresh interval %q: %w", v, err)
+		}
+		if interval < minRefreshInterval {
+			return nil, fmt.Errorf("refresh interval %s is shorter than the minimum of %s", interval, minRefreshInterval)
+		}
+		cfg.RefreshInterval = interval
+	}
+
+	if v := configValue(*updateTimeoutFlag, "UPDATE_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid update timeout %q: must be a positive duration such as 2h", v)
+		}
+		cfg.UpdateTimeout = timeout
+	}
+
+	return cfg, nil
+}
+
+// ---------------------- main
+
+// dryRun lists documents and comment IDs for every monitored docket and prints
+// how much fetching a real update would do, without fetching any comments.
+func dryRun(ctx context.Context, client *APIClient, cfg *Config, cache *Cache) error {
+	dockets, err := monitoredDockets(ctx, client, cfg)
+	if err != nil {
+		return err
+	}
+
+	var documents, comments, toFetch int
+	for _, docketID := range dockets {
+		documentCount, listed, missing, err := listDocketComments(ctx, client, cfg, cache, docketID)
+		if err != nil {
+			return fmt.Errorf("listing docket %s: %w", docketID, err)
+		}
+		fmt.Printf("%s: %d documents, %d comments listed, %d to fetch\n", docketID, documentCount, len(listed), len(missing))
+
+		documents += documentCount
+		comments += len(listed)
+		toFetch += len(missing)
+	}
+
+	// Each comment usually costs one request, since its attachments are
+	// included in the detail response.
+	requests := toFetch
+	estimate := time.Duration(float64(requests) / float64(client.requestRate()) * float64(time.Second))
+	fmt.Printf("Total: %d dockets, %d documents, %d comments, %d to fetch\n", len(dockets), documents, comments, toFetch)
+	fmt.Printf("Estimated requests: %d (about %v at %.0f requests/hour)\n", requests, estimate.Round(time.Second), float64(client.requestRate())*time.Hour.Seconds())
+	return nil
+}
+
+// runUpdate performs one cache update, persists the cache, and regenerates
+// the static outputs. An update cut short by UpdateTimeout still persists and
+// publishes what it fetched.
+func runUpdate(ctx context.Context, client *APIClient, cfg *Config, cache *Cache, resume *resumeTracker) error {
+	updateCtx := ctx
+	if cfg.UpdateTimeout > 0 {
+		var cancel context.CancelFunc
+		updateCtx, cancel = context.WithTimeout(ctx, cfg.UpdateTimeout)
+		defer cancel()
+	}
+	err := updateCache(updateCtx, client, cfg, cache, resume)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		// Whatever was fetched before the deadline is saved and published
+		// below; the next cycle picks up the rest.
+		slog.Warn("update cycle reached its deadline, keeping partial results", "timeout", cfg.UpdateTimeout)
+		err = fmt.Errorf("update cycle exceeded %s: %w", cfg.UpdateTimeout, err)
+	}
+	if err := cache.saveCache(cfg.CachePath); err != nil {
+		slog.Error("error saving cache", "path", cfg.CachePath, "error", err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if added := cache.recentlyAdded().CommentIDs; cfg.WebhookURL != "" && len(added) > 0 {
+		if err := notifyWebhook(ctx, cfg.WebhookURL, added); err != nil {
+			slog.Error("error notifying webhook", "error", err)
+		}
+	}
+	if quota, ok := client.quotaStatus(); ok {
+		slog.Info("API quota", "remaining", quota.Remaining, "limit", quota.Limit)
+	}
+
+	if htmlErr := generateHTML(cfg, cache); htmlErr != nil {
+		err = errors.Join(err, fmt.Errorf("generating HTML file: %w", htmlErr))
+	}
+	if csvErr := generateCSV(cfg, cache, filepath.Join(cfg.OutputDir, "comments.csv")); csvErr != nil {
+		err = errors.Join(err, fmt.Errorf("generating CSV file: %w", csvErr))
+	}
+	if jsonlErr := generateJSONL(cfg, cache, filepath.Join(cfg.OutputDir, "comments.jsonl")); jsonlErr != nil {
+		err = errors.Join(err, fmt.Errorf("generating JSON lines file: %w", jsonlErr))
+	}
+	if orgErr := generateOrganizationsHTML(cfg, cache); orgErr != nil {
+		err = errors.Join(err, fmt.Errorf("generating organizations HTML file: %w", orgErr))
+	}
+	if cfg.Precompress {
+		if gzErr := compressOutputs(cfg.OutputDir); gzErr != nil {
+			err = errors.Join(err, fmt.Errorf("compressing outputs: %w", gzErr))
+		}
+	}
+	return err
+}
+
+// updater runs cache updates for both the refresh loop and POST /refresh,
+// never more than one at a time.
+type updater struct {
+	client *APIClient
+	cfg    *Config
+	cache  *Cache
+	// resume checkpoints updates when -resume is set; it is nil otherwise.
+	resume *resumeTracker
+	// mu is held for the duration of an update; run does not wait for it.
+	mu sync.Mutex
+	// lastRefresh is when the last manual refresh started. It is guarded
+	// by mu.
+	lastRefresh time.Time
+}
+
+var errUpdateInProgress = errors.New("an update is already in progress")
+
+// run performs one update and returns the IDs of the comments it added. It
+// returns errUpdateInProgress instead of waiting if another update is running.
+func (u *updater) run(ctx context.Context) ([]string, error) {
+	if !u.mu.TryLock() {
+		return nil, errUpdateInProgress
+	}
+	defer u.mu.Unlock()
+	return u.runLocked(ctx)
+}
+
+// refresh is run for a manual refresh started at now. If the previous manual
+// refresh started less than refreshDebounce earlier, it returns how long to
+// wait instead. A refresh refused with errUpdateInProgress does not count
+// toward the debounce.
+func (u *updater) refresh(ctx context.Context, now time.Time) ([]string, time.Duration, error) {
+	if !u.mu.TryLock() {
+		return nil, 0, errUpdateInProgress
+	}
+	defer u.mu.Unlock()
+	if wait := u.lastRefresh.Add(refreshDebounce).Sub(now); wait > 0 {
+		return nil, wait, nil
+	}
+	u.lastRefresh = now
+	added, err := u.runLocked(ctx)
+	return added, 0, err
+}
+
+func (u *updater) runLocked(ctx context.Context) ([]string, error) {
+	err := runUpdate(ctx, u.client, u.cfg, u.cache, u.resume)
+	return u.cache.recentlyAdded().CommentIDs, err
+}
+
+// nextTick waits for the first tick of ticker at or after since, logging the
+// ticks skipped because an update was still running when they fired. It
+// returns false if ctx is canceled first.
+func nextTick(ctx context.Context, ticker *time.Ticker, since time.Time) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case tick := <-ticker.C:
+			if !tick.Before(since) {
+				return true
+			}
+			slog.Info("skipped scheduled update; the previous run was still active", "scheduled", tick.Format(time.RFC3339))
+		}
+	}
+}
+
+func main() {
+	var logLevel slog.LevelVar
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel})))
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := logLevel.UnmarshalText([]byte(v)); err != nil {
+			fatal("invalid LOG_LEVEL: expected debug, info, warn, or error", "value", v)
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	client := newAPIClient(cfg)
+	if cfg.ProxyURL != nil {
+		slog.Info("using proxy for outbound requests", "proxy", cfg.ProxyURL.Redacted())
+	}
+
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		fatal("error creating output directory", "path", cfg.OutputDir, "error", err)
+	}
+
+	cache, err := loadCache(cfg.CachePath)
+	if err != nil {
+		if !cfg.updating() {
+			// This process never writes the cache, so the file is left for
+			// the process that does.
+			slog.Error("error loading cache, serving empty until it can be reloaded", "path", cfg.CachePath, "error", err)
+		} else {
+			// Saving over the file would destroy the archive it holds.
+			moved, moveErr := moveAside(cfg.CachePath, time.Now())
+			if moveErr != nil {
+				fatal("error loading cache, and it could not be moved aside", "path", cfg.CachePath, "error", err, "moveError", moveErr)
+			}
+			slog.Error("error loading cache, moved it aside and starting empty", "path", cfg.CachePath, "movedTo", moved, "error", err)
+		}
+		cache = newCache()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.updating() {
+		if err := client.validateKeys(ctx); err != nil {
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden) {
+				fatal("API key was rejected by the API", "status", statusErr.StatusCode, "error", err)
+			}
+			slog.Warn("could not validate API keys, continuing anyway", "error", err)
+		}
+	}
+
+	var resume *resumeTracker
+	if cfg.Resume {
+		resume, err = loadResumeTracker(cfg.CachePath+".resume", cfg.CachePath)
+		if err != nil {
+			fatal("error loading resume file", "error", err)
+		}
+	}
+	var updates *updater
+	if cfg.updating() {
+		updates = &updater{client: client, cfg: cfg, cache: cache, resume: resume}
+	}
+
+	if cfg.DryRun {
+		if err := dryRun(ctx, client, cfg, cache); err != nil {
+			fatal("dry run failed", "error", err)
+		}
+		return
+	}
+
+	if cfg.Once {
+		if _, err := updates.run(ctx); err != nil {
+			fatal("update failed", "error", err)
+		}
+		return
+	}
+
+	updaterDone := make(chan struct{})
+	if updates != nil {
+		go func() {
+			defer close(updaterDone)
+			ticker := time.NewTicker(cfg.RefreshInterval)
+			defer ticker.Stop()
+			for {
+				_, err := updates.run(ctx)
+				switch {
+				case ctx.Err() != nil:
+					slog.Info("cache update canceled")
+					return
+				case errors.Is(err, errUpdateInProgress):
+					slog.Info("skipped scheduled update; a manual refresh is still running")
+				case err != nil:
+					slog.Error("error updating cache", "error", err)
+				}
+				if !nextTick(ctx, ticker, time.Now()) {
+					return
+				}
+			}
+		}()
+	} else {
+		// Another process owns updates; pick up the cache it writes so the
+		// JSON endpoints stay current.
+		go func() {
+			defer close(updaterDone)
+			for sleepContext(ctx, cfg.RefreshInterval) == nil {
+				loaded, err := loadCache(cfg.CachePath)
+				if err != nil {
+					slog.Error("error reloading cache", "path", cfg.CachePath, "error", err)
+					continue
+				}
+				cache.replace(loaded)
+			}
+		}()
+	}
+
+	if cfg.Mode == "update" {
+		<-updaterDone
+		slog.Info("shutdown complete")
+		return
+	}
+
+	switch {
+	case cfg.ForceHTTP:
+		slog.Info("serving plain HTTP", "reason", "-force-http")
+		startServer(ctx, cfg, newMux(ctx, cfg, cache, client, updates))
+	case cfg.Autocert:
+		startServerAutocert(ctx, cfg, newMux(ctx, cfg, cache, client, updates))
+	case certsAvailable(cfg.CertPath):
+		slog.Info("serving HTTPS", "certPath", cfg.CertPath)
+		startServerHTTPS(ctx, cfg, newMux(ctx, cfg, cache, client, updates))
+	default:
+		slog.Info("no certificates found at CERT_PATH, serving plain HTTP", "certPath", cfg.CertPath)
+		startServer(ctx, cfg, newMux(ctx, cfg, cache, client, updates))
+	}
 
-	startServerHTTPS()
-	// startServer()
+	<-updaterDone
+	slog.Info("shutdown complete")
 }
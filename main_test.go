@@ -0,0 +1,1201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// testConfig returns a configuration that points at srv and is rate limited
+// loosely enough not to slow tests down.
+func testConfig(srv *httptest.Server) *Config {
+	cfg := defaultConfig()
+	cfg.APIBaseURL = srv.URL
+	cfg.APIKeys = []string{"test-key"}
+	cfg.RequestsPerHour = 3600 * 1000
+	return cfg
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *APIClient {
+	t.Helper()
+	return newAPIClient(testConfig(srv))
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v any) {
+	t.Helper()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Errorf("encoding response: %v", err)
+	}
+}
+
+// pageNumber returns the page[number] query parameter of r, defaulting to 1.
+func pageNumber(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page[number]"))
+	if err != nil {
+		return 1
+	}
+	return page
+}
+
+func documentsPage(ids []string, totalPages int) map[string]any {
+	var data []map[string]any
+	for _, id := range ids {
+		data = append(data, map[string]any{"attributes": map[string]any{"objectId": id}})
+	}
+	return map[string]any{"data": data, "meta": map[string]any{"totalPages": totalPages}}
+}
+
+func TestDocumentObjectIDsPages(t *testing.T) {
+	pages := [][]string{{"0900001", "0900002"}, {"0900003"}, {"0900004", "0900005"}}
+	var requested []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/documents" || r.URL.Query().Get("filter[docketId]") != "NIST-2024-0001" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		page := pageNumber(r)
+		requested = append(requested, page)
+		writeJSON(t, w, documentsPage(pages[page-1], len(pages)))
+	}))
+	defer srv.Close()
+
+	ids, err := newTestClient(t, srv).DocumentObjectIDs(context.Background(), "NIST-2024-0001", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"0900001", "0900002", "0900003", "0900004", "0900005"}
+	if !slices.Equal(ids, want) {
+		t.Errorf("got IDs %v, want %v", ids, want)
+	}
+	if !slices.Equal(requested, []int{1, 2, 3}) {
+		t.Errorf("requested pages %v, want [1 2 3]", requested)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(srv)
+	cfg.HTTPTimeout = 50 * time.Millisecond
+	cfg.MaxAttempts = 1
+	start := time.Now()
+	_, err := newAPIClient(cfg).DocumentObjectIDs(context.Background(), "NIST-2024-0001", time.Time{})
+	if err == nil {
+		t.Fatal("expected a timeout error from a server that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v, want it to give up after about %v", elapsed, cfg.HTTPTimeout)
+	}
+}
+
+func TestFetchRetriesAfter429(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"errors":[{"status":"429","title":"Too Many Requests"}]}`, http.StatusTooManyRequests)
+			return
+		}
+		writeJSON(t, w, documentsPage([]string{"0900001"}, 1))
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	ids, err := newTestClient(t, srv).DocumentObjectIDs(context.Background(), "NIST-2024-0001", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []string{"0900001"}) {
+		t.Errorf("got IDs %v, want [0900001]", ids)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("server got %d requests, want 2", n)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want at least the 1s Retry-After", elapsed)
+	}
+}
+
+func testComment(id, text string) CommentWithAttachments {
+	var comment Comment
+	comment.Data.ID = id
+	comment.Data.Attributes.Comment = text
+	return CommentWithAttachments{ID: id, DocketID: "NIST-2024-0001", Comment: comment}
+}
+
+// TestCacheConcurrentAccess exercises the cache from several goroutines at
+// once. Run it with go test -race.
+func TestCacheConcurrentAccess(t *testing.T) {
+	cache := newCache()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := fmt.Sprintf("NIST-2024-0001-%04d", w*100+i)
+				if cache.needsFetch(id, "") {
+					cache.updateComment(id, testComment(id, "comment text"))
+				}
+				if i%25 == 0 {
+					cache.rebuildIndex()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				cache.snapshot()
+				cache.search("comment")
+				cache.stats()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n, _ := cache.stats(); n != 400 {
+		t.Errorf("cache has %d comments, want 400", n)
+	}
+}
+
+func TestDownloadAttachmentsKeepsMirroredNames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "contents of %s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(srv)
+	cfg.OutputDir = t.TempDir()
+	first := srv.URL + "/a/report.pdf"
+	second := srv.URL + "/b/report.pdf"
+	existing := filepath.Join(cfg.OutputDir, "attachments", "C1", "report.pdf")
+	if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	seen := newMirroredPaths()
+	seen.paths[first] = "attachments/C1/report.pdf"
+
+	mirrored, err := downloadAttachments(context.Background(), newAPIClient(cfg), cfg, "C1", []string{first, second}, nil, seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mirrored.localFiles[second]; got != "attachments/C1/report-1.pdf" {
+		t.Errorf("second attachment mirrored to %q, want attachments/C1/report-1.pdf", got)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "first" {
+		t.Errorf("existing file now contains %q", data)
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.OutputDir, "attachments", "C1", "report-1.pdf"))
+	if err != nil || string(data) != "contents of /b/report.pdf" {
+		t.Errorf("second attachment contains %q (%v)", data, err)
+	}
+}
+
+// fakeSource is a CommentSource backed by maps, for testing the update logic
+// without an API.
+type fakeSource struct {
+	documents   []string
+	listings    map[string][]CommentID
+	comments    map[string]Comment
+	attachments map[string][]Attachment
+
+	mu      sync.Mutex
+	fetched []string
+}
+
+func (f *fakeSource) DocumentObjectIDs(ctx context.Context, docketID string, modifiedSince time.Time) ([]string, error) {
+	return f.documents, nil
+}
+
+func (f *fakeSource) CommentIDs(ctx context.Context, documentID string, since time.Time, postedStart, postedEnd string) ([]CommentID, error) {
+	return f.listings[documentID], nil
+}
+
+func (f *fakeSource) Comment(ctx context.Context, commentID string) (Comment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetched = append(f.fetched, commentID)
+	return f.comments[commentID], nil
+}
+
+func (f *fakeSource) Attachments(ctx context.Context, attachmentURL string) ([]Attachment, error) {
+	return f.attachments[attachmentURL], nil
+}
+
+func listedComment(id, lastModified string) CommentID {
+	var listed CommentID
+	listed.ID = id
+	listed.Attributes.LastModifiedDate = lastModified
+	return listed
+}
+
+func TestUpdateDocketRefetchesModifiedComments(t *testing.T) {
+	cfg := defaultConfig()
+	cache := newCache()
+	source := &fakeSource{
+		documents: []string{"NIST-2024-0001-0001"},
+		listings: map[string][]CommentID{
+			"NIST-2024-0001-0001": {listedComment("C1", "2024-01-01T00:00:00Z"), listedComment("C2", "2024-01-01T00:00:00Z")},
+		},
+		comments: map[string]Comment{
+			"C1": testComment("C1", "original text").Comment,
+			"C2": testComment("C2", "unchanged text").Comment,
+		},
+	}
+	if err := updateDocket(context.Background(), source, cfg, cache, nil, "NIST-2024-0001"); err != nil {
+		t.Fatal(err)
+	}
+
+	source.fetched = nil
+	source.listings["NIST-2024-0001-0001"][0] = listedComment("C1", "2024-02-01T00:00:00Z")
+	source.comments["C1"] = testComment("C1", "amended text").Comment
+	if err := updateDocket(context.Background(), source, cfg, cache, nil, "NIST-2024-0001"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(source.fetched, []string{"C1"}) {
+		t.Errorf("second update fetched %v, want only the modified comment [C1]", source.fetched)
+	}
+	cached := cache.comments["C1"]
+	if got := cached.Comment.Data.Attributes.Comment; got != "amended text" {
+		t.Errorf("cached comment text is %q, want the amended text", got)
+	}
+	if cached.LastModified != "2024-02-01T00:00:00Z" {
+		t.Errorf("cached LastModified is %q, want the listed date", cached.LastModified)
+	}
+}
+
+// newStubAPI serves a docket with one document, three comments listed over
+// two pages, and attachments for the first comment.
+func newStubAPI(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/documents", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, documentsPage([]string{"0900006486a11b9c"}, 1))
+	})
+	mux.HandleFunc("/comments", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("filter[commentOnId]"); got != "0900006486a11b9c" {
+			t.Errorf("comments listed for document %q", got)
+		}
+		pages := [][]string{{"NIST-2024-0001-0002", "NIST-2024-0001-0003"}, {"NIST-2024-0001-0004"}}
+		var data []map[string]any
+		for _, id := range pages[pageNumber(r)-1] {
+			data = append(data, map[string]any{"id": id, "attributes": map[string]any{"lastModifiedDate": "2024-03-01T12:00:00Z"}})
+		}
+		writeJSON(t, w, map[string]any{"data": data, "meta": map[string]any{"totalElements": 3, "totalPages": 2}})
+	})
+	mux.HandleFunc("/comments/NIST-2024-0001-0002", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, map[string]any{"data": map[string]any{
+			"id": "NIST-2024-0001-0002",
+			"attributes": map[string]any{
+				"firstName":    "Ada",
+				"lastName":     "Lovelace",
+				"organization": "Analytical Engines",
+				"comment":      "Please see the attached letter.",
+				"postedDate":   "2024-02-28T05:00:00Z",
+			},
+			"relationships": map[string]any{"attachments": map[string]any{"links": map[string]any{
+				"related": "http://" + r.Host + "/comments/NIST-2024-0001-0002/attachments",
+			}}},
+		}})
+	})
+	mux.HandleFunc("/comments/NIST-2024-0001-0002/attachments", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, map[string]any{"data": []map[string]any{
+			{"attributes": map[string]any{"fileFormats": []map[string]any{
+				{"fileUrl": "https://downloads.regulations.gov/NIST-2024-0001-0002/attachment_1.pdf", "format": "pdf", "size": 2048},
+				{"fileUrl": "https://downloads.regulations.gov/NIST-2024-0001-0002/attachment_1.docx", "format": "docx", "size": 1024},
+			}}},
+		}})
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Api-Key"); got != "test-key" {
+			t.Errorf("request to %s has API key %q", r.URL, got)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAPIClient(t *testing.T) {
+	srv := newStubAPI(t)
+	client := newTestClient(t, srv)
+	ctx := context.Background()
+
+	t.Run("DocumentObjectIDs", func(t *testing.T) {
+		ids, err := client.DocumentObjectIDs(ctx, "NIST-2024-0001", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids, []string{"0900006486a11b9c"}) {
+			t.Errorf("got %v", ids)
+		}
+	})
+
+	t.Run("CommentIDs", func(t *testing.T) {
+		ids, err := client.CommentIDs(ctx, "0900006486a11b9c", time.Time{}, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, id := range ids {
+			got = append(got, id.ID)
+			if id.Attributes.LastModifiedDate != "2024-03-01T12:00:00Z" {
+				t.Errorf("%s has lastModifiedDate %q", id.ID, id.Attributes.LastModifiedDate)
+			}
+		}
+		want := []string{"NIST-2024-0001-0002", "NIST-2024-0001-0003", "NIST-2024-0001-0004"}
+		if !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Comment", func(t *testing.T) {
+		comment, err := client.Comment(ctx, "NIST-2024-0001-0002")
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs := comment.Data.Attributes
+		if comment.Data.ID != "NIST-2024-0001-0002" || attrs.FirstName != "Ada" || attrs.LastName != "Lovelace" ||
+			attrs.Organization != "Analytical Engines" || attrs.Comment != "Please see the attached letter." {
+			t.Errorf("unexpected comment %+v", comment.Data)
+		}
+		if got := parsePostedDate(comment); !got.Equal(time.Date(2024, 2, 28, 5, 0, 0, 0, time.UTC)) {
+			t.Errorf("posted date %v", got)
+		}
+		if related := comment.Data.Relationships.Attachments.Links.Related; related != srv.URL+"/comments/NIST-2024-0001-0002/attachments" {
+			t.Errorf("attachments link %q", related)
+		}
+	})
+
+	t.Run("Attachments", func(t *testing.T) {
+		attachments, err := client.Attachments(ctx, srv.URL+"/comments/NIST-2024-0001-0002/attachments")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Attachment{
+			{FileURL: "https://downloads.regulations.gov/NIST-2024-0001-0002/attachment_1.pdf", Format: "pdf", Size: 2048},
+			{FileURL: "https://downloads.regulations.gov/NIST-2024-0001-0002/attachment_1.docx", Format: "docx", Size: 1024},
+		}
+		if !slices.Equal(attachments, want) {
+			t.Errorf("got %+v, want %+v", attachments, want)
+		}
+	})
+}
+
+func TestUpdateDocketFetchesOverlappingCommentsOnce(t *testing.T) {
+	source := &fakeSource{
+		documents: []string{"D1", "D2"},
+		listings: map[string][]CommentID{
+			"D1": {listedComment("C1", ""), listedComment("C2", "")},
+			"D2": {listedComment("C2", ""), listedComment("C3", ""), listedComment("C1", "")},
+		},
+		comments: map[string]Comment{
+			"C1": testComment("C1", "one").Comment,
+			"C2": testComment("C2", "two").Comment,
+			"C3": testComment("C3", "three").Comment,
+		},
+	}
+	cfg := defaultConfig()
+	cache := newCache()
+
+	documents, listed, missing, err := listDocketComments(context.Background(), source, cfg, cache, "NIST-2024-0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if documents != 2 || len(listed) != 3 || len(missing) != 3 {
+		t.Errorf("got %d documents, %d listed, %d missing; want 2, 3, 3", documents, len(listed), len(missing))
+	}
+
+	if err := updateDocket(context.Background(), source, cfg, cache, nil, "NIST-2024-0001"); err != nil {
+		t.Fatal(err)
+	}
+	fetched := slices.Clone(source.fetched)
+	slices.Sort(fetched)
+	if !slices.Equal(fetched, []string{"C1", "C2", "C3"}) {
+		t.Errorf("fetched %v, want each comment once", source.fetched)
+	}
+}
+
+func TestFetchCommentWithoutAttachmentsLink(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/comments/NIST-2024-0001-0005" {
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"data": {"id": "NIST-2024-0001-0005", "attributes": {"comment": "No files here."}}}`))
+	}))
+	defer srv.Close()
+
+	cache := newCache()
+	err := fetchComment(context.Background(), newTestClient(t, srv), cache, "NIST-2024-0001", listedComment("NIST-2024-0001-0005", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, ok := cache.comments["NIST-2024-0001-0005"]
+	if !ok {
+		t.Fatal("comment was not cached")
+	}
+	if cached.Attachments == nil || len(cached.Attachments) != 0 {
+		t.Errorf("got attachments %#v, want an empty list", cached.Attachments)
+	}
+}
+
+func TestCacheReloadKeepsUpdateStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cache := newCache()
+	before := cache.commentIDs()
+	cache.updateComment("C1", testComment("C1", "text"))
+	cache.recordAdded(before, updated)
+	cache.markUpdated(updated)
+	if err := cache.saveCache(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A serve-only process starts empty and replaces its cache on reload.
+	served := newCache()
+	loaded, err := loadCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served.replace(loaded)
+
+	if _, last := served.stats(); !last.Equal(updated) {
+		t.Errorf("last successful update is %v, want %v", last, updated)
+	}
+	recent := served.recentlyAdded()
+	if !recent.Updated.Equal(updated) || !slices.Equal(recent.CommentIDs, []string{"C1"}) {
+		t.Errorf("recent additions are %+v", recent)
+	}
+}
+
+func TestGenerateHTMLReturnsWriteErrors(t *testing.T) {
+	cfg := defaultConfig()
+	// A file where the output directory should be makes every write fail.
+	cfg.OutputDir = filepath.Join(t.TempDir(), "static")
+	if err := os.WriteFile(cfg.OutputDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := generateHTML(cfg, newCache()); err == nil {
+		t.Error("expected an error when the output directory cannot be created")
+	}
+
+	cfg.OutputDir = t.TempDir()
+	if err := generateHTML(cfg, newCache()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.OutputDir, "index.html")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAttachmentsDropsDuplicateURLs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": [
+			{"attributes": {"fileFormats": [
+				{"fileUrl": "https://downloads.regulations.gov/C1/attachment_1.pdf", "format": "pdf"},
+				{"fileUrl": "https://downloads.regulations.gov/C1/attachment_1.pdf", "format": "pdf"},
+				{"fileUrl": "https://downloads.regulations.gov/C1/attachment_1.docx", "format": "docx"}
+			]}},
+			{"attributes": {"fileFormats": [
+				{"fileUrl": "https://downloads.regulations.gov/C1/attachment_2.pdf", "format": "pdf"},
+				{"fileUrl": "https://downloads.regulations.gov/C1/attachment_1.docx", "format": "docx"}
+			]}}
+		]}`))
+	}))
+	defer srv.Close()
+
+	attachments, err := newTestClient(t, srv).Attachments(context.Background(), srv.URL+"/comments/C1/attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://downloads.regulations.gov/C1/attachment_1.pdf",
+		"https://downloads.regulations.gov/C1/attachment_1.docx",
+		"https://downloads.regulations.gov/C1/attachment_2.pdf",
+	}
+	if got := attachmentURLs(attachments); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAttachmentFilename(t *testing.T) {
+	tests := []struct {
+		url, display, disk string
+	}{
+		{"https://downloads.regulations.gov/C1/comment.pdf", "comment.pdf", "comment.pdf"},
+		{"https://downloads.regulations.gov/C1/my comment.pdf", "my comment.pdf", "my_comment.pdf"},
+		{"https://downloads.regulations.gov/C1/my%20comment.pdf", "my comment.pdf", "my_comment.pdf"},
+		{"https://downloads.regulations.gov/C1/comment.pdf?version=2", "comment.pdf", "comment.pdf"},
+		{"https://downloads.regulations.gov/C1/a%2Fb.pdf", "a/b.pdf", "a_b.pdf"},
+		{"https://downloads.regulations.gov/C1/%3Cb%3E%20%26%20%22q%22.pdf", `<b> & "q".pdf`, "_b_____q_.pdf"},
+		{"https://downloads.regulations.gov/C1/..%2F..%2Fetc", "../../etc", "_.._etc"},
+		{"https://downloads.regulations.gov/", "", "attachment"},
+	}
+	for _, tt := range tests {
+		display := attachmentFilename(tt.url)
+		if display != tt.display {
+			t.Errorf("attachmentFilename(%q) = %q, want %q", tt.url, display, tt.display)
+		}
+		if disk := sanitizeFilename(display); disk != tt.disk {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", display, disk, tt.disk)
+		}
+	}
+}
+
+func TestAttachmentNamesAreEscapedInHTML(t *testing.T) {
+	comment := testComment("C1", "text")
+	comment.Attachments = []string{"https://downloads.regulations.gov/C1/%3Cb%3Ebold%3C%2Fb%3E%20%26%20more.pdf?x=1"}
+	page := newIndexPage(defaultConfig(), []CommentWithAttachments{comment}, "now", "", "", time.UTC)
+
+	var buf bytes.Buffer
+	if err := indexTemplate.Execute(&buf, page); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	if strings.Contains(html, "<b>bold</b>") {
+		t.Error("attachment name was not escaped")
+	}
+	if !strings.Contains(html, "&lt;b&gt;bold&lt;/b&gt; &amp; more.pdf") {
+		t.Error("escaped attachment name not found in the page")
+	}
+}
+
+func TestAttachmentFilenameIgnoresQuery(t *testing.T) {
+	for _, tt := range []struct{ url, want string }{
+		{"https://downloads.regulations.gov/C2/doc.pdf?version=2", "doc.pdf"},
+		{"https://downloads.regulations.gov/C2/doc.pdf?version=2#page=3", "doc.pdf"},
+		{"https://downloads.regulations.gov/C2/doc.pdf?name=other.pdf", "doc.pdf"},
+		// Not a valid URL; the query is still cut off.
+		{"https://downloads.regulations.gov/C2/%zz doc.pdf?version=2", "%zz doc.pdf"},
+	} {
+		if got := attachmentFilename(tt.url); got != tt.want {
+			t.Errorf("attachmentFilename(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pdf"))
+	}))
+	defer srv.Close()
+	cfg := testConfig(srv)
+	cfg.OutputDir = t.TempDir()
+	attachment := srv.URL + "/C2/doc.pdf?version=2"
+	seen := newMirroredPaths()
+	mirrored, err := downloadAttachments(context.Background(), newAPIClient(cfg), cfg, "C2", []string{attachment}, nil, seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mirrored.localFiles[attachment]; got != "attachments/C2/doc.pdf" {
+		t.Errorf("mirrored to %q, want attachments/C2/doc.pdf", got)
+	}
+}
+
+func TestFetchCommentUsesIncludedAttachments(t *testing.T) {
+	related := func(r *http.Request, id string) string {
+		return "http://" + r.Host + "/comments/" + id + "/attachments"
+	}
+	var relatedRequests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/comments/C3/attachments" && r.URL.Query().Get("include") != "attachments" {
+			t.Errorf("%s requested without include=attachments", r.URL)
+		}
+		switch r.URL.Path {
+		case "/comments/C1":
+			fmt.Fprintf(w, `{
+				"data": {"id": "C1", "relationships": {"attachments": {
+					"links": {"related": %q},
+					"data": [{"type": "attachments", "id": "A1"}, {"type": "attachments", "id": "A2"}]
+				}}},
+				"included": [
+					{"type": "attachments", "id": "A1", "attributes": {"fileFormats": [{"fileUrl": "https://downloads.regulations.gov/C1/attachment_1.pdf", "format": "pdf", "size": 10}]}},
+					{"type": "attachments", "id": "A2", "attributes": {"fileFormats": [{"fileUrl": "https://downloads.regulations.gov/C1/attachment_2.pdf", "format": "pdf", "size": 20}]}}
+				]
+			}`, related(r, "C1"))
+		case "/comments/C2":
+			// No attachments: the linkage is present but empty.
+			fmt.Fprintf(w, `{"data": {"id": "C2", "relationships": {"attachments": {"links": {"related": %q}, "data": []}}}}`, related(r, "C2"))
+		case "/comments/C3":
+			// The include was not honored; the related link must be followed.
+			fmt.Fprintf(w, `{"data": {"id": "C3", "relationships": {"attachments": {"links": {"related": %q}}}}}`, related(r, "C3"))
+		case "/comments/C3/attachments":
+			relatedRequests.Add(1)
+			w.Write([]byte(`{"data": [{"attributes": {"fileFormats": [{"fileUrl": "https://downloads.regulations.gov/C3/attachment_1.pdf"}]}}]}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t, srv)
+	cache := newCache()
+	for _, id := range []string{"C1", "C2", "C3"} {
+		if err := fetchComment(context.Background(), client, cache, "NIST-2024-0001", listedComment(id, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string][]string{
+		"C1": {"https://downloads.regulations.gov/C1/attachment_1.pdf", "https://downloads.regulations.gov/C1/attachment_2.pdf"},
+		"C2": {},
+		"C3": {"https://downloads.regulations.gov/C3/attachment_1.pdf"},
+	}
+	for id, urls := range want {
+		if got := cache.comments[id].Attachments; !slices.Equal(got, urls) {
+			t.Errorf("%s has attachments %v, want %v", id, got, urls)
+		}
+	}
+	if files := cache.comments["C1"].Files; len(files) != 2 || files[1].Size != 20 {
+		t.Errorf("C1 has files %+v", files)
+	}
+	if cache.comments["C1"].Comment.Included != nil {
+		t.Error("included resources were cached alongside Files")
+	}
+	if n := relatedRequests.Load(); n != 1 {
+		t.Errorf("related link fetched %d times, want once for C3", n)
+	}
+}
+
+func TestRequestsGoThroughProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "api.example.test" || r.URL.Path != "/v4/documents" {
+			t.Errorf("proxy got request for %s", r.URL)
+		}
+		proxied.Add(1)
+		writeJSON(t, w, documentsPage([]string{"0900001"}, 1))
+	}))
+	defer proxy.Close()
+
+	cfg := testConfig(proxy)
+	cfg.APIBaseURL = "http://api.example.test/v4"
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ProxyURL = proxyURL
+
+	ids, err := newAPIClient(cfg).DocumentObjectIDs(context.Background(), "NIST-2024-0001", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []string{"0900001"}) || proxied.Load() != 1 {
+		t.Errorf("got IDs %v after %d proxied requests", ids, proxied.Load())
+	}
+}
+
+func TestDownloadAttachmentsSkipsOversizedFiles(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small.pdf":
+			w.Write([]byte("small"))
+		case "/advertised.pdf":
+			w.Header().Set("Content-Length", "1000")
+			w.Write(make([]byte, 1000))
+		case "/streamed.pdf":
+			// Flushing before the body is complete leaves out Content-Length.
+			w.Write(make([]byte, 60))
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 60))
+		}
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(srv)
+	cfg.OutputDir = t.TempDir()
+	cfg.MaxAttachmentBytes = 100
+	attachments := []string{srv.URL + "/small.pdf", srv.URL + "/advertised.pdf", srv.URL + "/streamed.pdf"}
+	seen := newMirroredPaths()
+	mirrored, err := downloadAttachments(context.Background(), newAPIClient(cfg), cfg, "C1", attachments, nil, seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(mirrored.tooLarge, attachments[1:]) {
+		t.Errorf("too large: %v, want %v", mirrored.tooLarge, attachments[1:])
+	}
+	if _, ok := mirrored.localFiles[attachments[0]]; !ok || len(mirrored.localFiles) != 1 {
+		t.Errorf("local files: %v, want only the small file", mirrored.localFiles)
+	}
+	entries, err := os.ReadDir(filepath.Join(cfg.OutputDir, "attachments", "C1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "small.pdf" {
+		t.Errorf("attachment directory holds %v, want only small.pdf", entries)
+	}
+
+	// The page links to the original and marks it as too large.
+	comment := testComment("C1", "text")
+	comment.Attachments = attachments
+	comment.LocalFiles = mirrored.localFiles
+	comment.TooLarge = mirrored.tooLarge
+	row := newCommentRow(comment, time.UTC, "")
+	if link := row.Attachments[1]; link.URL != attachments[1] || !link.TooLarge {
+		t.Errorf("oversized attachment link is %+v", link)
+	}
+}
+
+func TestDownloadFileStreamsLargeBodies(t *testing.T) {
+	const chunk, chunks = 512 << 10, 8
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stalled.pdf" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		// Stream 4 MB over about twice the HTTP timeout.
+		for i := 0; i < chunks; i++ {
+			w.Write(bytes.Repeat([]byte{byte('a' + i)}, chunk))
+			w.(http.Flusher).Flush()
+			time.Sleep(25 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(srv)
+	cfg.HTTPTimeout = 100 * time.Millisecond
+	client := newAPIClient(cfg)
+	path := filepath.Join(t.TempDir(), "large.pdf")
+	_, modified, err := client.downloadFile(context.Background(), srv.URL+"/large.pdf", path, FileValidator{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified || info.Size() != chunk*chunks {
+		t.Errorf("downloaded %d bytes (modified %v), want %d", info.Size(), modified, chunk*chunks)
+	}
+
+	// A server that never sends headers still times out.
+	start := time.Now()
+	_, _, err = client.downloadFile(context.Background(), srv.URL+"/stalled.pdf", filepath.Join(t.TempDir(), "stalled.pdf"), FileValidator{}, 0)
+	if err == nil {
+		t.Error("expected a timeout from a server that never responds")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stalled download gave up after %v", elapsed)
+	}
+}
+
+func TestEmptyDocket(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/documents" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"data": [], "meta": {"totalElements": 0, "totalPages": 0}}`))
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(srv)
+	cfg.OutputDir = t.TempDir()
+	cfg.DocketIDs = []string{"NIST-2024-9999"}
+	cache := newCache()
+	if err := updateDocket(context.Background(), newAPIClient(cfg), cfg, cache, nil, "NIST-2024-9999"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := cache.stats(); n != 0 {
+		t.Errorf("cache has %d comments", n)
+	}
+
+	if err := generateHTML(cfg, cache); err != nil {
+		t.Fatal(err)
+	}
+	page, err := os.ReadFile(filepath.Join(cfg.OutputDir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), "No documents found for docket NIST-2024-9999.") {
+		t.Error("index.html does not explain that the docket has no documents")
+	}
+}
+
+func TestAPIErrorEnvelope(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errors": [
+			{"status": "400", "title": "The value of filter[docketId] is invalid", "detail": "Docket ID must match the agency pattern"},
+			{"status": "400", "title": "page[size] is out of range"}
+		]}`))
+	}))
+	defer srv.Close()
+
+	_, err := newTestClient(t, srv).DocumentObjectIDs(context.Background(), "NIST-2024-0001", time.Time{})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("got error %v, want a *StatusError", err)
+	}
+	if statusErr.StatusCode != http.StatusBadRequest || len(statusErr.APIErrors) != 2 {
+		t.Errorf("got status %d with API errors %+v", statusErr.StatusCode, statusErr.APIErrors)
+	}
+	for _, want := range []string{
+		"status 400",
+		"The value of filter[docketId] is invalid: Docket ID must match the agency pattern",
+		"page[size] is out of range",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("a 400 was requested %d times, want no retries", n)
+	}
+}
+
+func TestDownloadFileFailsCleanlyMidway(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write(make([]byte, 500))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "comment.pdf")
+	if err := os.WriteFile(path, []byte("previous copy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, srv)
+	_, _, err := client.downloadFile(context.Background(), srv.URL+"/comment.pdf", path, FileValidator{ETag: `"v1"`}, 0)
+	if err == nil {
+		t.Fatal("expected an error from a truncated download")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "previous copy" {
+		t.Errorf("file now contains %d bytes, want the previous copy", len(data))
+	}
+	if partials, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(partials) > 0 {
+		t.Errorf("partial files left behind: %v", partials)
+	}
+
+	// A partial file from a killed process is removed on the next pass, and
+	// the failed download is reported without being recorded as mirrored.
+	cfg := testConfig(srv)
+	cfg.OutputDir = dir
+	commentDir := filepath.Join(dir, "attachments", "C1")
+	if err := os.MkdirAll(commentDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(commentDir, ".comment.pdf.12345.tmp")
+	if err := os.WriteFile(stale, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	seen := newMirroredPaths()
+	mirrored, err := downloadAttachments(context.Background(), client, cfg, "C1", []string{srv.URL + "/comment.pdf"}, nil, seen)
+	if err == nil || mirrored.failed != 1 || len(mirrored.localFiles) != 0 {
+		t.Errorf("got error %v, %d failed, local files %v", err, mirrored.failed, mirrored.localFiles)
+	}
+	if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Error("stale partial download was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(commentDir, "comment.pdf")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("truncated download was left in place")
+	}
+}
+
+func TestMirrorAttachmentsDownloadsSharedFilesOnce(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("shared"))
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(srv)
+	cfg.OutputDir = t.TempDir()
+	cfg.MirrorConcurrency = 4
+	client := newAPIClient(cfg)
+	client.downloads = rate.NewLimiter(rate.Inf, 1)
+	shared := srv.URL + "/form-letter.pdf"
+	cache := newCache()
+	for _, id := range []string{"C1", "C2", "C3", "C4"} {
+		comment := testComment(id, "text")
+		comment.Attachments = []string{shared}
+		cache.updateComment(id, comment)
+	}
+
+	if err := mirrorAttachments(context.Background(), client, cfg, cache); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("shared attachment downloaded %d times, want once", n)
+	}
+	paths := make(map[string]bool)
+	for _, comment := range cache.snapshot() {
+		paths[comment.LocalFiles[shared]] = true
+	}
+	if len(paths) != 1 || paths[""] {
+		t.Errorf("comments map the shared attachment to %v, want one path", paths)
+	}
+}
+
+func TestRefreshEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": [], "meta": {"totalPages": 0}}`))
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(srv)
+	cfg.DocketIDs = []string{"NIST-2024-0001"}
+	cfg.OutputDir = t.TempDir()
+	cfg.CachePath = filepath.Join(t.TempDir(), "cache.json")
+	cfg.BasicAuthUser = "reader"
+	cfg.BasicAuthPassword = "secret"
+	cfg.RefreshToken = "refresh-token"
+	client := newAPIClient(cfg)
+	cache := newCache()
+	updates := &updater{client: client, cfg: cfg, cache: cache}
+	handler := newMux(context.Background(), cfg, cache, client, updates)
+
+	refresh := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+		req.Header.Set("Authorization", "Bearer refresh-token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A refresh refused because an update is running is not debounced.
+	updates.mu.Lock()
+	if rec := refresh(); rec.Code != http.StatusConflict {
+		t.Errorf("refresh during an update: got %d, want 409", rec.Code)
+	}
+	updates.mu.Unlock()
+
+	// The bearer token is accepted without basic auth credentials.
+	rec := refresh()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: got %d %s", rec.Code, rec.Body)
+	}
+	var result refreshResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || result.NewComments != 0 {
+		t.Errorf("refresh result %s (%v)", rec.Body, err)
+	}
+
+	if rec := refresh(); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("second refresh: got %d, want 429 with Retry-After", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.SetBasicAuth("reader", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh with basic auth instead of the token: got %d, want 401", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/recent", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("other endpoints without basic auth: got %d, want 401", rec.Code)
+	}
+}
+
+// TestCommentIDsBeyondPageLimit lists 50 comments two to a page, which takes
+// more pages than the API serves for one query.
+func TestCommentIDsBeyondPageLimit(t *testing.T) {
+	const total, perPage = 50, 2
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var windows atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		page := pageNumber(r)
+		if page > maxPageNumber {
+			http.Error(w, `{"errors":[{"status":"400","title":"page[number] must be at most 20"}]}`, http.StatusBadRequest)
+			return
+		}
+		if got := query.Get("sort"); got != "lastModifiedDate,documentId" {
+			t.Errorf("listing sorted by %q", got)
+		}
+		since := start
+		if ge := query.Get("filter[lastModifiedDate][ge]"); ge != "" {
+			since, err = time.ParseInLocation("2006-01-02 15:04:05", ge, loc)
+			if err != nil {
+				t.Errorf("filter[lastModifiedDate][ge]=%q: %v", ge, err)
+			}
+		}
+		if page == 1 {
+			windows.Add(1)
+		}
+
+		// Comment i was last modified i minutes after start.
+		var matching []map[string]any
+		for i := 0; i < total; i++ {
+			modified := start.Add(time.Duration(i) * time.Minute)
+			if !modified.Before(since) {
+				matching = append(matching, map[string]any{
+					"id":         fmt.Sprintf("NIST-2024-0001-%04d", i),
+					"attributes": map[string]any{"lastModifiedDate": modified.Format(time.RFC3339)},
+				})
+			}
+		}
+		from := min((page-1)*perPage, len(matching))
+		to := min(page*perPage, len(matching))
+		writeJSON(t, w, map[string]any{
+			"data": matching[from:to],
+			"meta": map[string]any{"totalElements": len(matching), "totalPages": (len(matching) + perPage - 1) / perPage},
+		})
+	}))
+	defer srv.Close()
+
+	ids, err := newTestClient(t, srv).CommentIDs(context.Background(), "0900006486a11b9c", time.Time{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != total {
+		t.Errorf("got %d comments, want %d", len(ids), total)
+	}
+	for i, id := range ids {
+		if want := fmt.Sprintf("NIST-2024-0001-%04d", i); id.ID != want {
+			t.Fatalf("comment %d is %s, want %s", i, id.ID, want)
+		}
+	}
+	if n := windows.Load(); n != 2 {
+		t.Errorf("listing took %d windows, want 2", n)
+	}
+}
+
+func TestUnreadableCacheIsMovedAside(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.json")
+	for _, contents := range []string{`{"schemaVersion": 1, "comments": {`, `{"schemaVersion": 99, "comments": {}}`} {
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadCache(path); err == nil {
+			t.Fatalf("loading %s: expected an error", contents)
+		}
+		moved, err := moveAside(path, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved != path+".bad-20240301T120000Z" {
+			t.Errorf("moved to %s", moved)
+		}
+		if data, _ := os.ReadFile(moved); string(data) != contents {
+			t.Errorf("moved file contains %q, want %q", data, contents)
+		}
+
+		// Saving the fresh cache no longer touches the unreadable one.
+		if err := newCache().saveCache(path); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(moved); string(data) != contents {
+			t.Error("moved file was overwritten")
+		}
+		os.Remove(moved)
+	}
+}
+
+func TestUpdateDocketResumesFromTracker(t *testing.T) {
+	dir := t.TempDir()
+	resume, err := loadResumeTracker(filepath.Join(dir, "cache.json.resume"), filepath.Join(dir, "cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume.begin("NIST-2024-0001", time.Now(), []CommentID{listedComment("C2", "")})
+	source := &fakeSource{
+		documents: []string{"D1"},
+		listings:  map[string][]CommentID{"D1": {listedComment("C1", ""), listedComment("C2", "")}},
+		comments: map[string]Comment{
+			"C1": testComment("C1", "one").Comment,
+			"C2": testComment("C2", "two").Comment,
+		},
+	}
+
+	cache := newCache()
+	if err := updateDocket(context.Background(), source, defaultConfig(), cache, resume, "NIST-2024-0001"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(source.fetched, []string{"C2"}) {
+		t.Errorf("fetched %v, want only the pending comment [C2]", source.fetched)
+	}
+	if _, pending := resume.pending("NIST-2024-0001"); pending {
+		t.Error("docket still pending after the update finished")
+	}
+}
+
+func TestHealthReportsCacheProgress(t *testing.T) {
+	cache := newCache()
+	cache.progress.start("NIST-2024-0001", 10)
+	cache.progress.advance()
+
+	rec := httptest.NewRecorder()
+	healthHandler(cache, newAPIClient(defaultConfig()))(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var status healthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Progress == nil || *status.Progress != (ProgressStatus{DocketID: "NIST-2024-0001", Done: 1, Total: 10}) {
+		t.Errorf("health reports progress %+v", status.Progress)
+	}
+
+	// Progress belongs to the cache it was recorded on.
+	rec = httptest.NewRecorder()
+	healthHandler(newCache(), newAPIClient(defaultConfig()))(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if strings.Contains(rec.Body.String(), "progress") {
+		t.Errorf("another cache reports progress: %s", rec.Body)
+	}
+}
+
+func TestRefreshLogsForwardedClient(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// A running update makes the handler return right after logging.
+	updates := &updater{}
+	updates.mu.Lock()
+	defer updates.mu.Unlock()
+	handler := refreshHandler(context.Background(), updates, "refresh-token", true)
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("Authorization", "Bearer refresh-token")
+	handler(httptest.NewRecorder(), req)
+
+	if !strings.Contains(logs.String(), "client=203.0.113.7") {
+		t.Errorf("refresh not logged with the forwarded client address: %s", logs.String())
+	}
+}